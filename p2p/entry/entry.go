@@ -1,11 +1,10 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"flag"
-	"io"
-	"log"
 	"net"
 	"os"
 )
@@ -14,6 +13,9 @@ import (
 type EntryConfig struct {
 	LocalAddr    string `json:"localAddr"`
 	ReceiverAddr string `json:"receiverAddr"`
+	// MetricsAddr, if set, serves Prometheus metrics on GET /metrics. See
+	// metrics.go.
+	MetricsAddr string `json:"metricsAddr"`
 }
 
 func loadEntryConfig(path string) (*EntryConfig, error) {
@@ -40,6 +42,10 @@ func main() {
 		log.Fatalf("Failed to load config: %v", err)
 	}
 
+	if cfg.MetricsAddr != "" {
+		go serveMetrics(context.Background(), cfg.MetricsAddr)
+	}
+
 	listener, err := net.Listen("tcp", cfg.LocalAddr)
 	if err != nil {
 		log.Fatalf("Failed to listen on %s: %v", cfg.LocalAddr, err)
@@ -54,6 +60,7 @@ func main() {
 			log.Printf("Failed to accept client connection: %v", err)
 			continue
 		}
+		connectionsTotal.Inc()
 		go handleEntryConnection(clientConn, cfg.ReceiverAddr)
 	}
 }
@@ -70,11 +77,11 @@ func handleEntryConnection(clientConn net.Conn, receiverAddr string) {
 
 	done := make(chan struct{})
 	go func() {
-		io.Copy(tlsConn, clientConn)
+		copyBuffer(tlsConn, clientConn, "out")
 		done <- struct{}{}
 	}()
 	go func() {
-		io.Copy(clientConn, tlsConn)
+		copyBuffer(clientConn, tlsConn, "in")
 		done <- struct{}{}
 	}()
 	<-done
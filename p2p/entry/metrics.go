@@ -0,0 +1,61 @@
+// metrics.go
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// log replaces the stdlib log package so messages get levels and
+// timestamps instead of bare Printf text.
+var log = logrus.New()
+
+var (
+	connectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "entry_connections_total",
+		Help: "Client connections accepted by the entry listener.",
+	})
+	bytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "entry_bytes_total",
+		Help: "Bytes relayed between the client and the receiver, by direction.",
+	}, []string{"direction"})
+)
+
+// bufferPool is a pool of reusable buffers for copyBuffer.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 32*1024) // 32KB buffer size
+	},
+}
+
+// copyBuffer copies from src to dst using a buffer from the pool, counting
+// the bytes copied against entry_bytes_total{direction}.
+func copyBuffer(dst io.Writer, src io.Reader, direction string) (written int64, err error) {
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+	written, err = io.CopyBuffer(dst, src, buf)
+	bytesTotal.WithLabelValues(direction).Add(float64(written))
+	return written, err
+}
+
+// serveMetrics runs the Prometheus /metrics endpoint on addr until ctx is
+// canceled.
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	httpServer := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.WithError(err).Error("metrics endpoint failed")
+	}
+}
@@ -1,11 +1,10 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"flag"
-	"io"
-	"log"
 	"net"
 	"os"
 )
@@ -16,6 +15,9 @@ type ReceiverConfig struct {
 	ForwardAddr string `json:"forwardAddr"`
 	CertFile    string `json:"certFile"`
 	KeyFile     string `json:"keyFile"`
+	// MetricsAddr, if set, serves Prometheus metrics on GET /metrics. See
+	// metrics.go.
+	MetricsAddr string `json:"metricsAddr"`
 }
 
 func loadReceiverConfig(path string) (*ReceiverConfig, error) {
@@ -47,6 +49,10 @@ func main() {
 		log.Fatalf("Failed to load cert/key: %v", err)
 	}
 
+	if cfg.MetricsAddr != "" {
+		go serveMetrics(context.Background(), cfg.MetricsAddr)
+	}
+
 	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
 	listener, err := tls.Listen("tcp", cfg.ListenAddr, tlsConfig)
 	if err != nil {
@@ -62,6 +68,7 @@ func main() {
 			log.Printf("Failed to accept entry connection: %v", err)
 			continue
 		}
+		connectionsTotal.Inc()
 		go handleReceiverConnection(entryConn, cfg.ForwardAddr)
 	}
 }
@@ -78,11 +85,11 @@ func handleReceiverConnection(entryConn net.Conn, forwardAddr string) {
 
 	done := make(chan struct{})
 	go func() {
-		io.Copy(targetConn, entryConn)
+		copyBuffer(targetConn, entryConn, "out")
 		done <- struct{}{}
 	}()
 	go func() {
-		io.Copy(entryConn, targetConn)
+		copyBuffer(entryConn, targetConn, "in")
 		done <- struct{}{}
 	}()
 	<-done
@@ -2,23 +2,37 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
-	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"flag"
 	"io"
-	"log"
 	"net"
 	"os"
 	"sync"
 	"time"
-
-	"github.com/hashicorp/yamux"
 )
 
+// bufferPool is a pool of reusable buffers for copyBuffer.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 32*1024) // 32KB buffer size
+	},
+}
+
+// copyBuffer copies from src to dst using a buffer from the pool, counting
+// the bytes copied against tunnel_stream_bytes_total{direction}.
+func copyBuffer(dst io.Writer, src io.Reader, direction string) (written int64, err error) {
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+	written, err = io.CopyBuffer(dst, src, buf)
+	streamBytesTotal.WithLabelValues(direction).Add(float64(written))
+	return written, err
+}
+
 // YamuxConfig holds yamux configuration
 type YamuxConfig struct {
 	AcceptBacklog         int    `json:"acceptBacklog"`
@@ -27,6 +41,11 @@ type YamuxConfig struct {
 	ConnectionWriteTimeout int    `json:"connectionWriteTimeout"` // milliseconds
 	MaxStreamWindowSize   uint32 `json:"maxStreamWindowSize"`
 	MaxConcurrentConnections int  `json:"maxConcurrentConnections"`
+	// NumConn opens this many parallel TCP carriers (raw transport only)
+	// and stripes yamux frames across them via multiConn, instead of
+	// capping throughput at one socket's congestion window. 1 or unset
+	// keeps the original single-connection behavior.
+	NumConn int `json:"numConn"`
 }
 
 // Config holds client configuration
@@ -37,6 +56,39 @@ type Config struct {
 	PublicKeyPath    string     `json:"publicKeyPath"`
 	SecretToken      string     `json:"secretToken"`
 	UseMux           bool       `json:"useMux"`
+	// Handshake selects the tunnel authentication scheme: "" (default)
+	// for the legacy RSA-PKCS1v15 one-shot token, or "noise-ik" for the
+	// mutually-authenticated, forward-secret Noise IK handshake. Only
+	// consulted by the tcp-yamux wire; tls-mimic always authenticates as
+	// part of its own handshake. See handshake.go.
+	Handshake string `json:"handshake"`
+	// NoiseStaticKeyPath is this client's own Curve25519 static private
+	// key for the noise-ik handshake, raw or hex-encoded.
+	NoiseStaticKeyPath string `json:"noiseStaticKeyPath"`
+	// NoiseKeyringPath lists the server's current and recently-rotated
+	// static public keys, newline-separated hex, one per line. dialNoiseIK
+	// tries each in order, so a client reconnecting mid-rotation still
+	// finds the key the server is currently advertising.
+	NoiseKeyringPath string `json:"noiseKeyringPath"`
+	// Transport selects how the tunnel connection to the server is
+	// established: "raw" (default), "tls-mimic" or "websocket". See
+	// transport.go.
+	Transport string `json:"transport"`
+	// RemotePorts, when non-empty, tells the server which ports to
+	// publish on our behalf instead of relying on its own
+	// UserListenAddr config. See control.go.
+	RemotePorts []RemotePort `json:"remotePorts"`
+	// Wire selects the carrier the session rides on: "tcp-yamux" (default)
+	// or "kcp-smux" (KCP with Reed-Solomon FEC, better suited to lossy WAN
+	// links). See wire.go and kcp.go.
+	Wire string    `json:"wire"`
+	KCP  KCPConfig `json:"kcp"`
+	// MetricsAddr, if set, serves Prometheus metrics on GET /metrics. See
+	// metrics.go.
+	MetricsAddr string `json:"metricsAddr"`
+	// PingInterval is how often the active session is probed with
+	// session.Ping() to sample yamux_ping_rtt_seconds. Defaults to 30s.
+	PingInterval int `json:"pingInterval"` // milliseconds
 }
 
 func loadPublicKey(path string) (*rsa.PublicKey, error) {
@@ -58,145 +110,75 @@ func loadPublicKey(path string) (*rsa.PublicKey, error) {
 func main() {
 	configPath := flag.String("config", "client_config.json", "Path to config file")
 	flag.Parse()
-	for {
-		// Load config
-		file, err := os.Open(*configPath)
-		if err != nil {
-			log.Fatalf("Failed to open config: %v", err)
-		}
-		var cfg Config
-		if err := json.NewDecoder(file).Decode(&cfg); err != nil {
-			file.Close()
-			log.Fatalf("Failed to decode config: %v", err)
-		}
-		file.Close()
-		// Build yamux.Config from cfg.Yamux
-		yamuxConf := yamux.DefaultConfig()
-		yamuxConf.AcceptBacklog = cfg.Yamux.AcceptBacklog
-		yamuxConf.EnableKeepAlive = cfg.Yamux.EnableKeepAlive
-		yamuxConf.KeepAliveInterval = time.Duration(cfg.Yamux.KeepAliveInterval) * time.Millisecond
-		yamuxConf.ConnectionWriteTimeout = time.Duration(cfg.Yamux.ConnectionWriteTimeout) * time.Millisecond
-		if cfg.Yamux.MaxStreamWindowSize > 0 {
-			yamuxConf.MaxStreamWindowSize = cfg.Yamux.MaxStreamWindowSize
-		}
-		maxConcurrentStreams := cfg.Yamux.MaxConcurrentConnections
+	c, err := NewClient(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if err := c.Run(context.Background()); err != nil {
+		log.Fatalf("Client exited: %v", err)
+	}
+}
+
+// runSingleConn handles the legacy cfg.UseMux=false mode: a single tunnel
+// connection with no stream multiplexer, relaying exactly one local
+// service.
+func runSingleConn(cfg *Config) {
+	transport, err := newTransport(cfg.Transport)
+	if err != nil {
+		log.Fatalf("Invalid transport: %v", err)
+	}
+
+	log.Println("Connecting to tunnel server at", cfg.TunnelServerAddr)
+	tunnelConn, err := transport.DialTunnel(context.Background(), cfg.TunnelServerAddr, cfg)
+	if err != nil {
+		log.Printf("Failed to connect to tunnel server: %v", err)
+		time.Sleep(3 * time.Second)
+		return
+	}
+	log.Println("Tunnel connection established")
 
-		// Load server public key (path from config)
+	// tls-mimic already authenticates as part of its handshake, so skip
+	// the legacy exchange.
+	if cfg.Transport != "tls-mimic" {
 		publicKey, err := loadPublicKey(cfg.PublicKeyPath)
 		if err != nil {
 			log.Printf("Failed to load public key: %v", err)
+			tunnelConn.Close()
 			time.Sleep(3 * time.Second)
-			continue
-		}
-
-		log.Println("Connecting to tunnel server at", cfg.TunnelServerAddr)
-		// Connect to tunnel server
-		tunnelConn, err := net.Dial("tcp", cfg.TunnelServerAddr)
-		if err != nil {
-			log.Printf("Failed to connect to tunnel server: %v", err)
-			time.Sleep(3 * time.Second)
-			continue
+			return
 		}
-		log.Println("Tunnel TCP connection established")
-
-		// --- AUTHENTICATION HANDSHAKE ---
 		token := []byte(cfg.SecretToken)
 		encToken, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, token)
 		if err != nil {
 			log.Printf("Failed to encrypt token: %v", err)
 			tunnelConn.Close()
 			time.Sleep(3 * time.Second)
-			continue
+			return
 		}
 		if _, err := tunnelConn.Write(encToken); err != nil {
 			log.Printf("Failed to send encrypted token: %v", err)
 			tunnelConn.Close()
 			time.Sleep(3 * time.Second)
-			continue
+			return
 		}
 		log.Println("Sent encrypted token to server for authentication")
-		// --- END AUTHENTICATION HANDSHAKE ---
-
-		if cfg.UseMux {
-			// Create yamux client session
-			session, err := yamux.Client(tunnelConn, yamuxConf)
-			if err != nil {
-				log.Printf("Failed to create yamux session: %v", err)
-				tunnelConn.Close()
-				time.Sleep(3 * time.Second)
-				continue
-			}
-			log.Println("Yamux session established with server")
-
-			// Accept yamux streams in a loop, with concurrency limit
-			var localIdx int
-			var streamCountMu sync.Mutex
-			streamCount := 0
-			for {
-				streamCountMu.Lock()
-				if maxConcurrentStreams > 0 && streamCount >= maxConcurrentStreams {
-					streamCountMu.Unlock()
-					time.Sleep(100 * time.Millisecond)
-					continue
-				}
-				streamCount++
-				streamCountMu.Unlock()
+	}
 
-				stream, err := session.AcceptStream()
-				if err != nil {
-					streamCountMu.Lock()
-					streamCount--
-					streamCountMu.Unlock()
-					log.Printf("Failed to accept yamux stream: %v", err)
-					break
-				}
-				log.Println("Accepted new yamux stream from server")
-				// Pick local address in round-robin fashion
-				localAddr := cfg.LocalListenAddr[localIdx]
-				localIdx = (localIdx + 1) % len(cfg.LocalListenAddr)
-				go func(stream net.Conn, localAddr string) {
-					defer stream.Close()
-					defer func() {
-						streamCountMu.Lock()
-						streamCount--
-						streamCountMu.Unlock()
-					}()
-					// Connect to local xray-core (or any local service)
-					localConn, err := net.Dial("tcp", localAddr)
-					if err != nil {
-						log.Printf("Failed to connect to local service at %s: %v", localAddr, err)
-						return
-					}
-					log.Printf("Connected to local service %s for new stream", localAddr)
-					defer localConn.Close()
-					// Forward data between yamux stream and local service
-					go io.Copy(localConn, stream)
-					io.Copy(stream, localConn)
-				}(stream, localAddr)
-			}
-			session.Close()
-			tunnelConn.Close()
-			log.Println("Connection lost, retrying in 3 seconds...")
-			time.Sleep(3 * time.Second)
-		} else {
-			// No yamux: handle tunnel as a single connection
-			var localIdx int
-			localAddr := cfg.LocalListenAddr[localIdx]
-			localIdx = (localIdx + 1) % len(cfg.LocalListenAddr)
-			localConn, err := net.Dial("tcp", localAddr)
-			if err != nil {
-				log.Printf("Failed to connect to local service at %s: %v", localAddr, err)
-				tunnelConn.Close()
-				time.Sleep(3 * time.Second)
-				continue
-			}
-			log.Printf("Connected to local service %s for tunnel", localAddr)
-			go io.Copy(localConn, tunnelConn)
-			io.Copy(tunnelConn, localConn)
-			localConn.Close()
-			tunnelConn.Close()
-			log.Println("Connection closed, retrying in 3 seconds...")
-			time.Sleep(3 * time.Second)
-		}
+	var localIdx int
+	localAddr := cfg.LocalListenAddr[localIdx]
+	localIdx = (localIdx + 1) % len(cfg.LocalListenAddr)
+	localConn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		log.Printf("Failed to connect to local service at %s: %v", localAddr, err)
+		tunnelConn.Close()
+		time.Sleep(3 * time.Second)
+		return
 	}
+	log.Printf("Connected to local service %s for tunnel", localAddr)
+	go copyBuffer(localConn, tunnelConn, "out")
+	copyBuffer(tunnelConn, localConn, "in")
+	localConn.Close()
+	tunnelConn.Close()
+	log.Println("Connection closed")
+	time.Sleep(3 * time.Second)
 }
\ No newline at end of file
@@ -0,0 +1,198 @@
+// control.go
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+)
+
+// The client declares which remote ports the server should publish
+// (chisel/frp-style remote forwarding) over a dedicated yamux control
+// stream, the first stream opened on the session. Messages are
+// length-prefixed JSON; data streams carrying forwarded traffic are
+// prefixed with a 4-byte listenerID so they can be routed to the local
+// address that was registered for that listener.
+
+// ControlMessageType identifies the payload carried by a ControlMessage.
+type ControlMessageType string
+
+const (
+	MsgOpenListener   ControlMessageType = "open_listener"
+	MsgCloseListener  ControlMessageType = "close_listener"
+	MsgListenerOpened ControlMessageType = "listener_opened"
+	MsgStats          ControlMessageType = "stats"
+	MsgPing           ControlMessageType = "ping"
+	MsgPong           ControlMessageType = "pong"
+)
+
+// ControlMessage is the envelope sent over the control stream; exactly one
+// of the payload fields is populated, matching Type.
+type ControlMessage struct {
+	Type           ControlMessageType `json:"type"`
+	OpenListener   *OpenListenerMsg   `json:"openListener,omitempty"`
+	CloseListener  *CloseListenerMsg  `json:"closeListener,omitempty"`
+	ListenerOpened *ListenerOpenedMsg `json:"listenerOpened,omitempty"`
+	Stats          *StatsMsg          `json:"stats,omitempty"`
+}
+
+type OpenListenerMsg struct {
+	ID       uint32 `json:"id"`
+	BindAddr string `json:"bindAddr"`
+	Proto    string `json:"proto"`
+}
+
+type CloseListenerMsg struct {
+	ID uint32 `json:"id"`
+}
+
+type ListenerOpenedMsg struct {
+	ID         uint32 `json:"id"`
+	ActualAddr string `json:"actualAddr"`
+	Error      string `json:"error,omitempty"`
+}
+
+type StatsMsg struct {
+	ID          uint32 `json:"id"`
+	BytesIn     int64  `json:"bytesIn"`
+	BytesOut    int64  `json:"bytesOut"`
+	ActiveConns int32  `json:"activeConns"`
+}
+
+// listenerIDHeaderLen is the size of the listenerID header prepended to
+// every data stream opened for a remotely forwarded connection.
+const listenerIDHeaderLen = 4
+
+// RemotePort is one port the client asks the server to publish, forwarded
+// back to LocalAddr once a connection arrives.
+type RemotePort struct {
+	BindAddr  string `json:"bindAddr"`
+	Proto     string `json:"proto"`
+	LocalAddr string `json:"localAddr"`
+}
+
+func writeControlMessage(w io.Writer, msg *ControlMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(body)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+func readControlMessage(r io.Reader) (*ControlMessage, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	var msg ControlMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func readListenerID(r io.Reader) (uint32, error) {
+	header := make([]byte, listenerIDHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(header), nil
+}
+
+// runRemoteForwarding accepts the control stream, registers every
+// configured RemotePort with the server, and then forwards each
+// subsequent data stream to the local address registered for its
+// listenerID. It blocks for the life of the session.
+func runRemoteForwarding(session Session, remotePorts []RemotePort) error {
+	stream, err := session.AcceptStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	localAddrs := make(map[uint32]string, len(remotePorts))
+	for i, rp := range remotePorts {
+		id := uint32(i)
+		localAddrs[id] = rp.LocalAddr
+		msg := &ControlMessage{Type: MsgOpenListener, OpenListener: &OpenListenerMsg{ID: id, BindAddr: rp.BindAddr, Proto: rp.Proto}}
+		if err := writeControlMessage(stream, msg); err != nil {
+			return err
+		}
+	}
+
+	go logControlReplies(stream)
+
+	for {
+		dataStream, err := session.AcceptStream()
+		if err != nil {
+			return err
+		}
+		go handleRemoteForwardStream(dataStream, localAddrs)
+	}
+}
+
+// logControlReplies drains ListenerOpened/Stats/Pong messages from the
+// server and logs them until the stream closes.
+func logControlReplies(stream io.Reader) {
+	for {
+		msg, err := readControlMessage(stream)
+		if err != nil {
+			return
+		}
+		switch msg.Type {
+		case MsgListenerOpened:
+			if msg.ListenerOpened.Error != "" {
+				log.Printf("control: listener %d rejected by server: %s", msg.ListenerOpened.ID, msg.ListenerOpened.Error)
+			} else {
+				log.Printf("control: listener %d published on %s", msg.ListenerOpened.ID, msg.ListenerOpened.ActualAddr)
+			}
+		case MsgStats:
+			log.Printf("control: listener %d stats: in=%d out=%d active=%d",
+				msg.Stats.ID, msg.Stats.BytesIn, msg.Stats.BytesOut, msg.Stats.ActiveConns)
+		case MsgPong:
+			// keepalive reply, nothing to do
+		default:
+			log.Printf("control: ignoring unexpected message type %q", msg.Type)
+		}
+	}
+}
+
+// handleRemoteForwardStream reads the listenerID header off a data stream
+// opened by the server and forwards the remaining bytes to the local
+// address registered for that listener.
+func handleRemoteForwardStream(stream net.Conn, localAddrs map[uint32]string) {
+	defer stream.Close()
+
+	id, err := readListenerID(stream)
+	if err != nil {
+		log.Printf("control: failed to read listener header: %v", err)
+		return
+	}
+	localAddr, ok := localAddrs[id]
+	if !ok {
+		log.Printf("control: no local address configured for listener %d", id)
+		return
+	}
+	localConn, err := net.Dial("tcp", localAddr)
+	if err != nil {
+		log.Printf("Failed to connect to local service at %s: %v", localAddr, err)
+		return
+	}
+	defer localConn.Close()
+	log.Printf("Connected to local service %s for listener %d", localAddr, id)
+	streamsOpen.Inc()
+	defer streamsOpen.Dec()
+	go copyBuffer(localConn, stream, "out")
+	copyBuffer(stream, localConn, "in")
+}
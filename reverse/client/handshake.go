@@ -0,0 +1,253 @@
+// handshake.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Handshake version byte. Both the legacy RSA-PKCS1v15 token exchange and
+// the noise-ik handshake below send this as the very first byte of the
+// tunnel connection, so a server with both kinds of client still attached
+// can tell which one it's talking to before reading anything else.
+const (
+	handshakeVersionLegacy  byte = 0x01
+	handshakeVersionNoiseIK byte = 0x02
+)
+
+var noiseCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+// Message lengths for the Noise IK pattern ("-> e, es, s, ss" then
+// "<- e, ee, se") with an empty payload on both messages: message 1 is an
+// unencrypted ephemeral key, the initiator's static key sealed with its
+// own tag, and then the AEAD tag WriteMessage always appends for the
+// (here empty) payload once a key exists; message 2 is the responder's
+// ephemeral key plus that same trailing empty-payload tag.
+const (
+	noiseMsg1Len = 32 + (32 + 16) + 16
+	noiseMsg2Len = 32 + 16
+)
+
+// noisePrologue derives the Noise prologue from the shared SecretToken, so
+// a client that doesn't know the token produces a different transcript
+// hash and fails the handshake MAC even if it holds a valid static
+// keypair of its own.
+func noisePrologue(secretToken string) []byte {
+	h := sha256.Sum256([]byte("tunnelengine-noise-ik|" + secretToken))
+	return h[:]
+}
+
+// decodeCurve25519Key parses a static private key file holding either the
+// raw 32-byte key or its 64-character hex encoding, and derives the
+// matching public key.
+func decodeCurve25519Key(raw []byte) (noise.DHKey, error) {
+	raw = bytes.TrimSpace(raw)
+	priv := make([]byte, 32)
+	switch len(raw) {
+	case 32:
+		copy(priv, raw)
+	case 64:
+		if _, err := hex.Decode(priv, raw); err != nil {
+			return noise.DHKey{}, errors.New("expected 32 raw or 64 hex-encoded bytes")
+		}
+	default:
+		return noise.DHKey{}, errors.New("expected 32 raw or 64 hex-encoded bytes")
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	return noise.DHKey{Private: priv, Public: pub}, nil
+}
+
+// loadNoiseStaticKey reads this client's own Curve25519 static private key
+// for the noise-ik handshake.
+func loadNoiseStaticKey(path string) (noise.DHKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return noise.DHKey{}, fmt.Errorf("noise-ik: reading static key %s: %w", path, err)
+	}
+	return decodeCurve25519Key(raw)
+}
+
+// loadNoiseKeyring reads a file of newline-separated hex-encoded
+// Curve25519 public keys for the server's current and recently-rotated
+// static keys, in the order dialNoiseIK should try them. Blank lines and
+// lines starting with "#" are ignored.
+func loadNoiseKeyring(path string) ([][]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("noise-ik: reading keyring %s: %w", path, err)
+	}
+	var keys [][]byte
+	for _, line := range strings.Split(string(raw), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pub, err := hex.DecodeString(line)
+		if err != nil || len(pub) != 32 {
+			return nil, fmt.Errorf("noise-ik: keyring %s: invalid public key %q", path, line)
+		}
+		keys = append(keys, pub)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("noise-ik: keyring %s has no keys", path)
+	}
+	return keys, nil
+}
+
+// dialNoiseIK runs the initiator side of the Noise IK handshake, trying
+// each candidate server static key from cfg.NoiseKeyringPath in order. A
+// failed attempt redials the transport from scratch, since a Noise
+// message exchange that doesn't verify has already consumed the
+// connection it ran on.
+func dialNoiseIK(ctx context.Context, addr string, cfg *Config, transport Transport) (net.Conn, error) {
+	staticKey, err := loadNoiseStaticKey(cfg.NoiseStaticKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	peerKeys, err := loadNoiseKeyring(cfg.NoiseKeyringPath)
+	if err != nil {
+		return nil, err
+	}
+	prologue := noisePrologue(cfg.SecretToken)
+	var lastErr error
+	for _, peerPub := range peerKeys {
+		conn, err := transport.DialTunnel(ctx, addr, cfg)
+		if err != nil {
+			return nil, err
+		}
+		secured, err := attemptNoiseIKDial(conn, staticKey, peerPub, prologue)
+		if err != nil {
+			conn.Close()
+			lastErr = err
+			continue
+		}
+		return secured, nil
+	}
+	err = fmt.Errorf("noise-ik: handshake failed against every key in the keyring: %w", lastErr)
+	recordHandshakeFailure("noise_invalid_server", err)
+	return nil, err
+}
+
+func attemptNoiseIKDial(conn net.Conn, staticKey noise.DHKey, peerStatic []byte, prologue []byte) (net.Conn, error) {
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   noiseCipherSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeIK,
+		Initiator:     true,
+		Prologue:      prologue,
+		StaticKeypair: staticKey,
+		PeerStatic:    peerStatic,
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg1, _, _, err := hs.WriteMessage(nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("noise-ik: failed to build handshake message 1: %w", err)
+	}
+	if _, err := conn.Write(append([]byte{handshakeVersionNoiseIK}, msg1...)); err != nil {
+		err = fmt.Errorf("noise-ik: failed to send handshake message 1: %w", err)
+		recordHandshakeFailure("noise_send_msg1", err)
+		return nil, err
+	}
+	msg2 := make([]byte, noiseMsg2Len)
+	if _, err := io.ReadFull(conn, msg2); err != nil {
+		return nil, fmt.Errorf("noise-ik: failed to read handshake message 2: %w", err)
+	}
+	_, cs0, cs1, err := hs.ReadMessage(nil, msg2)
+	if err != nil {
+		return nil, fmt.Errorf("noise-ik: handshake message 2 failed to verify: %w", err)
+	}
+	return newNoiseFramedConn(conn, cs0, cs1, false), nil
+}
+
+// noiseFramedConn wraps a net.Conn, post-handshake, with per-session
+// ChaCha20-Poly1305 framing: each record is a 2-byte big-endian length
+// (of the sealed payload, 16-byte tag included) followed by the sealed
+// bytes themselves. The nonce is the noise.CipherState's own monotonic
+// counter, so there's no separate sequence number to track here.
+type noiseFramedConn struct {
+	net.Conn
+	writeCipher, readCipher *noise.CipherState
+	writeMu, readMu         sync.Mutex
+	readBuf                 []byte
+}
+
+// noiseFrameMaxPlaintext keeps each record's sealed length comfortably
+// under the 2-byte length prefix's 65535-byte ceiling.
+const noiseFrameMaxPlaintext = 16 * 1024
+
+func newNoiseFramedConn(conn net.Conn, cs0, cs1 *noise.CipherState, isServer bool) *noiseFramedConn {
+	c := &noiseFramedConn{Conn: conn}
+	if isServer {
+		c.readCipher, c.writeCipher = cs0, cs1
+	} else {
+		c.writeCipher, c.readCipher = cs0, cs1
+	}
+	return c
+}
+
+func (c *noiseFramedConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	total := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > noiseFrameMaxPlaintext {
+			chunk = chunk[:noiseFrameMaxPlaintext]
+		}
+		sealed, err := c.writeCipher.Encrypt(nil, nil, chunk)
+		if err != nil {
+			return total, fmt.Errorf("noise-ik: failed to seal record: %w", err)
+		}
+		frame := make([]byte, 2+len(sealed))
+		binary.BigEndian.PutUint16(frame, uint16(len(sealed)))
+		copy(frame[2:], sealed)
+		if _, err := c.Conn.Write(frame); err != nil {
+			return total, err
+		}
+		total += len(chunk)
+		p = p[len(chunk):]
+	}
+	return total, nil
+}
+
+func (c *noiseFramedConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.readBuf) == 0 {
+		lenHeader := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, lenHeader); err != nil {
+			return 0, err
+		}
+		sealed := make([]byte, binary.BigEndian.Uint16(lenHeader))
+		if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+			return 0, err
+		}
+		plain, err := c.readCipher.Decrypt(nil, nil, sealed)
+		if err != nil {
+			return 0, fmt.Errorf("noise-ik: failed to open record: %w", err)
+		}
+		c.readBuf = plain
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
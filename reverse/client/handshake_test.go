@@ -0,0 +1,175 @@
+// handshake_test.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/flynn/noise"
+)
+
+// fakeTunnelTransport hands dialNoiseIK one end of an in-memory net.Pipe
+// instead of actually dialing addr, so the handshake can be exercised
+// without a real socket.
+type fakeTunnelTransport struct{ conn net.Conn }
+
+func (t fakeTunnelTransport) DialTunnel(ctx context.Context, addr string, cfg *Config) (net.Conn, error) {
+	return t.conn, nil
+}
+
+// respondNoiseIK runs the responder side of the Noise IK handshake
+// directly against the noise library (rather than through acceptNoiseIK,
+// which lives in the server binary and can't be imported from here),
+// reading exactly noiseMsg1Len/writing exactly noiseMsg2Len bytes. A
+// wrong msg1/msg2 length here is exactly the bug this test catches: a
+// short or long read would make hs.ReadMessage fail its MAC check.
+func respondNoiseIK(t *testing.T, conn net.Conn, staticKey noise.DHKey, prologue []byte) net.Conn {
+	t.Helper()
+	verByte := make([]byte, 1)
+	if _, err := conn.Read(verByte); err != nil {
+		t.Fatalf("failed to read handshake version byte: %v", err)
+	}
+	if verByte[0] != handshakeVersionNoiseIK {
+		t.Fatalf("unexpected handshake version byte 0x%02x", verByte[0])
+	}
+	msg1 := make([]byte, noiseMsg1Len)
+	if _, err := readFull(conn, msg1); err != nil {
+		t.Fatalf("failed to read handshake message 1: %v", err)
+	}
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite:   noiseCipherSuite,
+		Random:        rand.Reader,
+		Pattern:       noise.HandshakeIK,
+		Initiator:     false,
+		Prologue:      prologue,
+		StaticKeypair: staticKey,
+	})
+	if err != nil {
+		t.Fatalf("failed to build responder handshake state: %v", err)
+	}
+	if _, _, _, err := hs.ReadMessage(nil, msg1); err != nil {
+		t.Fatalf("handshake message 1 failed to verify: %v", err)
+	}
+	msg2, cs0, cs1, err := hs.WriteMessage(nil, nil)
+	if err != nil {
+		t.Fatalf("failed to build handshake message 2: %v", err)
+	}
+	if len(msg2) != noiseMsg2Len {
+		t.Fatalf("handshake message 2 is %d bytes, want noiseMsg2Len=%d", len(msg2), noiseMsg2Len)
+	}
+	if _, err := conn.Write(msg2); err != nil {
+		t.Fatalf("failed to send handshake message 2: %v", err)
+	}
+	return newNoiseFramedConn(conn, cs0, cs1, true)
+}
+
+func readFull(conn net.Conn, buf []byte) (int, error) {
+	n := 0
+	for n < len(buf) {
+		m, err := conn.Read(buf[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// writeStaticKeyFile writes priv (32 raw bytes) hex-encoded to a temp
+// file, the format loadNoiseStaticKey/decodeCurve25519Key expect.
+func writeStaticKeyFile(t *testing.T, dir, name string, priv []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(priv)), 0o600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	return path
+}
+
+// TestDialNoiseIKCompletesHandshake exercises the real dialNoiseIK against
+// a hand-rolled responder over a net.Pipe. It pins down the exact wire
+// format dialNoiseIK/acceptNoiseIK must agree on (noiseMsg1Len/
+// noiseMsg2Len): a miscounted length here makes the responder's
+// hs.ReadMessage fail on every handshake, which is the bug this guards.
+func TestDialNoiseIKCompletesHandshake(t *testing.T) {
+	dir := t.TempDir()
+
+	clientStatic, err := decodeCurve25519Key(randomKeyBytes(t))
+	if err != nil {
+		t.Fatalf("failed to build client static key: %v", err)
+	}
+	serverStatic, err := decodeCurve25519Key(randomKeyBytes(t))
+	if err != nil {
+		t.Fatalf("failed to build server static key: %v", err)
+	}
+
+	clientKeyPath := writeStaticKeyFile(t, dir, "client.key", clientStatic.Private)
+	keyringPath := filepath.Join(dir, "keyring.txt")
+	if err := os.WriteFile(keyringPath, []byte(hex.EncodeToString(serverStatic.Public)+"\n"), 0o600); err != nil {
+		t.Fatalf("failed to write keyring: %v", err)
+	}
+
+	cfg := &Config{
+		SecretToken:        "integration-test-token",
+		NoiseStaticKeyPath: clientKeyPath,
+		NoiseKeyringPath:   keyringPath,
+	}
+
+	clientConn, serverConn := net.Pipe()
+	transport := fakeTunnelTransport{conn: clientConn}
+
+	type serverResult struct {
+		conn net.Conn
+	}
+	serverDone := make(chan serverResult, 1)
+	go func() {
+		conn := respondNoiseIK(t, serverConn, serverStatic, noisePrologue(cfg.SecretToken))
+		serverDone <- serverResult{conn: conn}
+	}()
+
+	clientSecured, err := dialNoiseIK(context.Background(), "ignored", cfg, transport)
+	if err != nil {
+		t.Fatalf("dialNoiseIK failed: %v", err)
+	}
+
+	var serverSecured net.Conn
+	select {
+	case res := <-serverDone:
+		serverSecured = res.conn
+	case <-time.After(2 * time.Second):
+		t.Fatalf("responder side never completed the handshake")
+	}
+
+	// Prove the derived AEAD keys actually work end to end, not just that
+	// the handshake messages parsed.
+	const msg = "hello over noise-ik"
+	go func() {
+		if _, err := clientSecured.Write([]byte(msg)); err != nil {
+			t.Errorf("client write failed: %v", err)
+		}
+	}()
+	buf := make([]byte, len(msg))
+	if _, err := readFull(serverSecured, buf); err != nil {
+		t.Fatalf("server read failed: %v", err)
+	}
+	if string(buf) != msg {
+		t.Fatalf("server got %q, want %q", buf, msg)
+	}
+}
+
+// randomKeyBytes returns 32 random bytes suitable as a Curve25519 private
+// scalar (curve25519.X25519 clamps internally, so any 32 bytes work).
+func randomKeyBytes(t *testing.T) []byte {
+	t.Helper()
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("failed to generate key material: %v", err)
+	}
+	return b
+}
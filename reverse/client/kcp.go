@@ -0,0 +1,140 @@
+// kcp.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+)
+
+// handshakeIDLen is the size of the random, non-secret identifier sent
+// alongside the RSA token over the TCP handshake and again as the first
+// bytes of the KCP connection that follows, so the server can match the
+// two up explicitly instead of assuming they arrive in the same order
+// they were dialed (see kcpSmuxListener.Accept).
+const handshakeIDLen = 16
+
+// KCPConfig tunes the KCP session used by the kcp-smux wire. See
+// xtaci/kcp-go's ReadConfig/NoDelay docs for the meaning of each field;
+// zero values fall back to kcp-go's own defaults.
+type KCPConfig struct {
+	DataShards   int `json:"dataShards"`
+	ParityShards int `json:"parityShards"`
+	NoDelay      int `json:"noDelay"`
+	Interval     int `json:"interval"`
+	Resend       int `json:"resend"`
+	NC           int `json:"nc"`
+	SndWnd       int `json:"sndWnd"`
+	RcvWnd       int `json:"rcvWnd"`
+	MTU          int `json:"mtu"`
+}
+
+// kcpSessionAdapter adapts *smux.Session's concretely-typed stream methods
+// to the generic Session interface.
+type kcpSessionAdapter struct{ s *smux.Session }
+
+func (a kcpSessionAdapter) OpenStream() (net.Conn, error)   { return a.s.OpenStream() }
+func (a kcpSessionAdapter) AcceptStream() (net.Conn, error) { return a.s.AcceptStream() }
+func (a kcpSessionAdapter) Close() error                    { return a.s.Close() }
+func (a kcpSessionAdapter) IsClosed() bool                  { return a.s.IsClosed() }
+
+// Ping is unsupported: smux, unlike yamux, doesn't expose a keepalive RTT
+// probe. pingLoop (see metrics.go) treats this error as "stop sampling"
+// rather than retrying forever.
+func (a kcpSessionAdapter) Ping() (time.Duration, error) {
+	return 0, errors.New("kcp-smux: session does not support Ping")
+}
+
+// kcpSmuxWire runs the tunnel over KCP (with Reed-Solomon FEC) instead of
+// raw TCP, and smux instead of yamux on top. The RSA token handshake still
+// runs first, over a short TCP connection to the same address, generating
+// a fresh session key that's reused to AEAD-wrap the KCP connection before
+// smux sees it.
+type kcpSmuxWire struct{}
+
+func (kcpSmuxWire) Dial(ctx context.Context, addr string, cfg *Config) (Session, io.Closer, error) {
+	publicKey, err := loadPublicKey(cfg.PublicKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	handshakeConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer handshakeConn.Close()
+
+	encToken, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, []byte(cfg.SecretToken))
+	if err != nil {
+		err = fmt.Errorf("kcp-smux: failed to encrypt token: %w", err)
+		recordHandshakeFailure("encrypt_token", err)
+		return nil, nil, err
+	}
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, nil, fmt.Errorf("kcp-smux: failed to generate session key: %w", err)
+	}
+	handshakeID := make([]byte, handshakeIDLen)
+	if _, err := rand.Read(handshakeID); err != nil {
+		return nil, nil, fmt.Errorf("kcp-smux: failed to generate handshake id: %w", err)
+	}
+	payload := append(append([]byte{}, encToken...), sessionKey...)
+	payload = append(payload, handshakeID...)
+	if _, err := handshakeConn.Write(payload); err != nil {
+		return nil, nil, fmt.Errorf("kcp-smux: failed to send handshake packet: %w", err)
+	}
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(handshakeConn, ack); err != nil {
+		return nil, nil, fmt.Errorf("kcp-smux: failed to read handshake ack: %w", err)
+	}
+
+	kcpConn, err := kcp.DialWithOptions(addr, nil, cfg.KCP.DataShards, cfg.KCP.ParityShards)
+	if err != nil {
+		return nil, nil, fmt.Errorf("kcp-smux: failed to dial: %w", err)
+	}
+	applyKCPTuning(kcpConn, &cfg.KCP)
+
+	// Lead with handshakeID so the server, which may have this KCP
+	// connection arrive interleaved with another client's, can tell which
+	// pending TCP handshake it belongs to instead of assuming "most recent
+	// handshake, next KCP accept".
+	if _, err := kcpConn.Write(handshakeID); err != nil {
+		kcpConn.Close()
+		return nil, nil, fmt.Errorf("kcp-smux: failed to send handshake id: %w", err)
+	}
+
+	aead, err := newAEADFromKey(sessionKey)
+	if err != nil {
+		kcpConn.Close()
+		return nil, nil, err
+	}
+	secureConn := newAEADConn(kcpConn, aead, false)
+
+	smuxConf := smux.DefaultConfig()
+	session, err := smux.Client(secureConn, smuxConf)
+	if err != nil {
+		kcpConn.Close()
+		return nil, nil, err
+	}
+	return kcpSessionAdapter{session}, kcpConn, nil
+}
+
+func applyKCPTuning(conn *kcp.UDPSession, cfg *KCPConfig) {
+	if cfg.NoDelay != 0 || cfg.Interval != 0 || cfg.Resend != 0 || cfg.NC != 0 {
+		conn.SetNoDelay(cfg.NoDelay, cfg.Interval, cfg.Resend, cfg.NC)
+	}
+	if cfg.SndWnd > 0 || cfg.RcvWnd > 0 {
+		conn.SetWindowSize(cfg.SndWnd, cfg.RcvWnd)
+	}
+	if cfg.MTU > 0 {
+		conn.SetMtu(cfg.MTU)
+	}
+}
@@ -0,0 +1,230 @@
+// reload.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultPingInterval is used when Config.PingInterval is unset.
+const defaultPingInterval = 30 * time.Second
+
+// Client owns the tunnel client's lifecycle: it dials the tunnel server
+// over the configured Wire and relays streams to LocalListenAddr, and
+// supports reloading the config file (SIGHUP) without dropping the active
+// session — LocalListenAddr changes take effect on the very next stream,
+// instead of waiting for a reconnect.
+type Client struct {
+	configPath string
+
+	mu       sync.Mutex
+	cfg      Config
+	localIdx int
+}
+
+// NewClient loads the initial config from path and returns a Client ready
+// to Run.
+func NewClient(path string) (*Client, error) {
+	cfg, err := loadClientConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{configPath: path, cfg: cfg}, nil
+}
+
+func loadClientConfig(path string) (Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer file.Close()
+	var cfg Config
+	if err := json.NewDecoder(file).Decode(&cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// Run dials the tunnel server in a reconnect loop until ctx is canceled,
+// watching for SIGHUP the whole time.
+func (c *Client) Run(ctx context.Context) error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	if metricsAddr := c.snapshotConfig().MetricsAddr; metricsAddr != "" {
+		go serveMetrics(ctx, metricsAddr)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigCh:
+				log.Println("client: SIGHUP received, reloading config")
+				if err := c.reload(); err != nil {
+					log.Printf("client: reload failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := c.runOnce(ctx); err != nil {
+			log.Printf("Connection lost: %v", err)
+		}
+		reconnectsTotal.Inc()
+		log.Println("Retrying in 3 seconds...")
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// reload re-reads the config file and swaps it in. LocalListenAddr takes
+// effect on the very next stream of the active session (see nextLocalAddr);
+// everything else (Transport, Wire, SecretToken, ...) takes effect on the
+// next reconnect, since those are tied to dialing the session itself.
+func (c *Client) reload() error {
+	newCfg, err := loadClientConfig(c.configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+	c.mu.Lock()
+	old := c.cfg
+	c.cfg = newCfg
+	c.mu.Unlock()
+	if len(old.LocalListenAddr) != len(newCfg.LocalListenAddr) {
+		log.Printf("client: local listen address pool updated (%d -> %d entries)", len(old.LocalListenAddr), len(newCfg.LocalListenAddr))
+	}
+	return nil
+}
+
+func (c *Client) snapshotConfig() Config {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cfg
+}
+
+// nextLocalAddr picks the next local address in round-robin fashion from
+// whatever LocalListenAddr pool is current, so a reload takes effect
+// immediately instead of waiting for a reconnect.
+func (c *Client) nextLocalAddr() (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.cfg.LocalListenAddr) == 0 {
+		return "", false
+	}
+	addr := c.cfg.LocalListenAddr[c.localIdx%len(c.cfg.LocalListenAddr)]
+	c.localIdx++
+	return addr, true
+}
+
+// runOnce dials one tunnel session and serves it until it ends. It blocks
+// for the life of one session.
+func (c *Client) runOnce(ctx context.Context) error {
+	cfg := c.snapshotConfig()
+
+	if !cfg.UseMux {
+		// No session multiplexer at all, so the Wire abstraction (which
+		// exists to plug in multiplexers) doesn't apply: dial the
+		// transport directly and handle the tunnel as a single
+		// connection, as before.
+		runSingleConn(&cfg)
+		return nil
+	}
+
+	wire, err := newWire(cfg.Wire)
+	if err != nil {
+		return fmt.Errorf("invalid wire: %w", err)
+	}
+
+	log.Println("Connecting to tunnel server at", cfg.TunnelServerAddr)
+	session, carrier, err := wire.Dial(ctx, cfg.TunnelServerAddr, &cfg)
+	if err != nil {
+		return fmt.Errorf("failed to connect to tunnel server: %w", err)
+	}
+	log.Println("Tunnel session established with server")
+	defer carrier.Close()
+	defer session.Close()
+
+	sessionsActive.Inc()
+	defer sessionsActive.Dec()
+
+	pingInterval := defaultPingInterval
+	if cfg.PingInterval > 0 {
+		pingInterval = time.Duration(cfg.PingInterval) * time.Millisecond
+	}
+	pingStop := make(chan struct{})
+	defer close(pingStop)
+	go pingLoop(session, pingInterval, pingStop)
+
+	// When we declare remote ports, the server creates listeners on
+	// demand instead of us round-robining across a static LocalListenAddr
+	// pool.
+	if len(cfg.RemotePorts) > 0 {
+		return runRemoteForwarding(session, cfg.RemotePorts)
+	}
+
+	maxConcurrentStreams := cfg.Yamux.MaxConcurrentConnections
+	var streamCountMu sync.Mutex
+	streamCount := 0
+	for {
+		streamCountMu.Lock()
+		if maxConcurrentStreams > 0 && streamCount >= maxConcurrentStreams {
+			streamCountMu.Unlock()
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		streamCount++
+		streamCountMu.Unlock()
+
+		stream, err := session.AcceptStream()
+		if err != nil {
+			streamCountMu.Lock()
+			streamCount--
+			streamCountMu.Unlock()
+			return fmt.Errorf("failed to accept stream: %w", err)
+		}
+		log.Println("Accepted new stream from server")
+		localAddr, ok := c.nextLocalAddr()
+		if !ok {
+			log.Printf("client: no local listen addresses configured, dropping stream")
+			stream.Close()
+			streamCountMu.Lock()
+			streamCount--
+			streamCountMu.Unlock()
+			continue
+		}
+		go func(stream net.Conn, localAddr string) {
+			defer stream.Close()
+			defer func() {
+				streamCountMu.Lock()
+				streamCount--
+				streamCountMu.Unlock()
+			}()
+			localConn, err := net.Dial("tcp", localAddr)
+			if err != nil {
+				log.Printf("Failed to connect to local service at %s: %v", localAddr, err)
+				return
+			}
+			log.Printf("Connected to local service %s for new stream", localAddr)
+			defer localConn.Close()
+			streamsOpen.Inc()
+			defer streamsOpen.Dec()
+			go copyBuffer(localConn, stream, "out")
+			copyBuffer(stream, localConn, "in")
+		}(stream, localAddr)
+	}
+}
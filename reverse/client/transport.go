@@ -0,0 +1,308 @@
+// transport.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport abstracts how the tunnel connection to the server is
+// established, so the yamux session can ride over something other than a
+// bare TCP socket.
+type Transport interface {
+	DialTunnel(ctx context.Context, addr string, cfg *Config) (net.Conn, error)
+}
+
+// newTransport builds the Transport named by cfg.Transport ("raw" if
+// unset).
+func newTransport(name string) (Transport, error) {
+	switch name {
+	case "", "raw":
+		return rawTransport{}, nil
+	case "tls-mimic":
+		return tlsMimicTransport{}, nil
+	case "websocket":
+		return websocketTransport{}, nil
+	default:
+		return nil, errors.New("unknown transport: " + name)
+	}
+}
+
+// rawTransport is the original behavior: a bare TCP dial. The RSA token
+// handshake is performed by the caller afterwards, same as before this
+// Transport abstraction existed.
+type rawTransport struct{}
+
+func (rawTransport) DialTunnel(ctx context.Context, addr string, cfg *Config) (net.Conn, error) {
+	return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+}
+
+// websocketTransport wraps the yamux session inside an HTTP Upgrade so the
+// tunnel can traverse CDNs/reverse proxies that only forward HTTP(S). The
+// RSA token handshake still runs over the resulting connection, same as
+// rawTransport.
+type websocketTransport struct{}
+
+func (websocketTransport) DialTunnel(ctx context.Context, addr string, cfg *Config) (net.Conn, error) {
+	u := url.URL{Scheme: "ws", Host: addr, Path: "/tunnel"}
+	dialer := websocket.Dialer{}
+	wsConn, _, err := dialer.DialContext(ctx, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return newWSConn(wsConn), nil
+}
+
+// wsConn adapts a *websocket.Conn to net.Conn by buffering partial message
+// reads, since yamux expects a plain byte stream rather than framed
+// messages.
+type wsConn struct {
+	*websocket.Conn
+	readMu sync.Mutex
+	rest   []byte
+}
+
+func newWSConn(c *websocket.Conn) *wsConn {
+	return &wsConn{Conn: c}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.rest) == 0 {
+		_, data, err := c.Conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.rest = data
+	}
+	n := copy(p, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.Conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// tlsMimicTransport makes the handshake look like a real TLS ClientHello/
+// ServerHello exchange (the ClientHello-smuggling trick from Cloak) while
+// actually carrying the RSA-encrypted auth token and a per-connection
+// session key inside the ClientHello's random/session_id/SNI fields.
+// Subsequent bytes are AEAD-wrapped with the session key before yamux
+// ever sees them.
+type tlsMimicTransport struct{}
+
+const (
+	tlsRecordHeaderLen    = 5
+	tlsHandshakeHeaderLen = 4
+	fakeClientRandomLen   = 32
+	fakeSessionIDLen      = 32
+	rsaCiphertextLen      = 256 // 2048-bit RSA key, PKCS#1 v1.5
+)
+
+func (tlsMimicTransport) DialTunnel(ctx context.Context, addr string, cfg *Config) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := loadPublicKey(cfg.PublicKeyPath)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	payload := append([]byte(cfg.SecretToken), sessionKey...)
+	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, payload)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if len(ciphertext) != rsaCiphertextLen {
+		conn.Close()
+		return nil, fmt.Errorf("tls-mimic: unexpected RSA ciphertext size %d", len(ciphertext))
+	}
+	if _, err := conn.Write(buildFakeClientHello(ciphertext)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := readFakeServerHello(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	aead, err := newAEADFromKey(sessionKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newAEADConn(conn, aead, false), nil
+}
+
+// buildFakeClientHello frames ciphertext (exactly rsaCiphertextLen bytes)
+// inside a TLS 1.2-shaped ClientHello record: 32 bytes into random, 32
+// bytes into session_id, and the remaining 192 bytes into a fake SNI
+// extension payload.
+func buildFakeClientHello(ciphertext []byte) []byte {
+	random := ciphertext[:fakeClientRandomLen]
+	sessionID := ciphertext[fakeClientRandomLen : fakeClientRandomLen+fakeSessionIDLen]
+	sniPayload := ciphertext[fakeClientRandomLen+fakeSessionIDLen:]
+
+	var body bytes.Buffer
+	body.Write([]byte{0x03, 0x03}) // client_version: TLS 1.2
+	body.Write(random)
+	body.WriteByte(byte(len(sessionID)))
+	body.Write(sessionID)
+	cipherSuites := []byte{0xc0, 0x2f, 0xc0, 0x30, 0x00, 0x9e}
+	binary.Write(&body, binary.BigEndian, uint16(len(cipherSuites)))
+	body.Write(cipherSuites)
+	body.WriteByte(1) // compression methods length
+	body.WriteByte(0) // null compression
+	extensions := buildFakeSNIExtension(sniPayload)
+	binary.Write(&body, binary.BigEndian, uint16(len(extensions)))
+	body.Write(extensions)
+
+	handshake := make([]byte, tlsHandshakeHeaderLen+body.Len())
+	handshake[0] = 0x01 // ClientHello
+	putUint24(handshake[1:4], uint32(body.Len()))
+	copy(handshake[4:], body.Bytes())
+
+	record := make([]byte, tlsRecordHeaderLen+len(handshake))
+	record[0] = 0x16 // handshake content type
+	record[1], record[2] = 0x03, 0x01
+	binary.BigEndian.PutUint16(record[3:5], uint16(len(handshake)))
+	copy(record[5:], handshake)
+	return record
+}
+
+func buildFakeSNIExtension(payload []byte) []byte {
+	serverName := make([]byte, 3+len(payload))
+	serverName[0] = 0 // name_type: host_name
+	binary.BigEndian.PutUint16(serverName[1:3], uint16(len(payload)))
+	copy(serverName[3:], payload)
+
+	serverNameList := make([]byte, 2+len(serverName))
+	binary.BigEndian.PutUint16(serverNameList[0:2], uint16(len(serverName)))
+	copy(serverNameList[2:], serverName)
+
+	ext := make([]byte, 4+len(serverNameList))
+	binary.BigEndian.PutUint16(ext[0:2], 0x0000) // extension type: server_name
+	binary.BigEndian.PutUint16(ext[2:4], uint16(len(serverNameList)))
+	copy(ext[4:], serverNameList)
+	return ext
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
+
+func readFakeServerHello(conn net.Conn) error {
+	header := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	recordLen := int(binary.BigEndian.Uint16(header[3:5]))
+	body := make([]byte, recordLen)
+	_, err := io.ReadFull(conn, body)
+	return err
+}
+
+// newAEADFromKey derives an AES-256-GCM AEAD from the tls-mimic session
+// key.
+func newAEADFromKey(key []byte) (cipher.AEAD, error) {
+	h := sha256.Sum256(key)
+	block, err := aes.NewCipher(h[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aeadConn wraps a net.Conn so every write is sealed and every read is
+// opened with an AEAD keyed from the tls-mimic session secret. Frames are
+// a 4-byte big-endian length prefix followed by the sealed payload.
+type aeadConn struct {
+	net.Conn
+	aead              cipher.AEAD
+	writeDir, readDir byte
+	writeSeq, readSeq uint64
+	writeMu, readMu   sync.Mutex
+	readBuf           []byte
+}
+
+func newAEADConn(conn net.Conn, aead cipher.AEAD, isServer bool) *aeadConn {
+	c := &aeadConn{Conn: conn, aead: aead}
+	if isServer {
+		c.writeDir, c.readDir = 'S', 'C'
+	} else {
+		c.writeDir, c.readDir = 'C', 'S'
+	}
+	return c
+}
+
+func nonceFor(seq uint64, direction byte) []byte {
+	nonce := make([]byte, 12)
+	nonce[0] = direction
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func (c *aeadConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	sealed := c.aead.Seal(nil, nonceFor(c.writeSeq, c.writeDir), p, nil)
+	c.writeSeq++
+	frame := make([]byte, 4+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+	copy(frame[4:], sealed)
+	if _, err := c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *aeadConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.readBuf) == 0 {
+		lenHeader := make([]byte, 4)
+		if _, err := io.ReadFull(c.Conn, lenHeader); err != nil {
+			return 0, err
+		}
+		sealed := make([]byte, binary.BigEndian.Uint32(lenHeader))
+		if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+			return 0, err
+		}
+		plain, err := c.aead.Open(nil, nonceFor(c.readSeq, c.readDir), sealed, nil)
+		if err != nil {
+			return 0, err
+		}
+		c.readSeq++
+		c.readBuf = plain
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
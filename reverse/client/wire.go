@@ -0,0 +1,181 @@
+// wire.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Session is the subset of a multiplexed session (yamux or smux) the rest
+// of the client needs: opening/accepting streams and tearing the whole
+// thing down. Both *yamux.Session and *smux.Session are adapted to this
+// interface below.
+type Session interface {
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+	Close() error
+	IsClosed() bool
+	// Ping round-trips a keepalive frame and reports how long it took, for
+	// the yamux_ping_rtt_seconds metric (see metrics.go). Sessions that
+	// can't support it (smux, see kcp.go) return an error.
+	Ping() (time.Duration, error)
+}
+
+// Wire abstracts the dialer and the session constructor, so the tunnel can
+// run over plain TCP+yamux (the original design) or over KCP+smux (see
+// kcp.go, better suited to lossy WAN links) without the rest of the client
+// caring which.
+type Wire interface {
+	// Dial establishes one tunnel session to addr. The returned io.Closer
+	// is the underlying carrier(s) to close alongside the session.
+	Dial(ctx context.Context, addr string, cfg *Config) (Session, io.Closer, error)
+}
+
+func newWire(name string) (Wire, error) {
+	switch name {
+	case "", "tcp-yamux":
+		return tcpYamuxWire{}, nil
+	case "kcp-smux":
+		return kcpSmuxWire{}, nil
+	default:
+		return nil, fmt.Errorf("unknown wire: %s", name)
+	}
+}
+
+func buildYamuxConfig(cfg YamuxConfig) *yamux.Config {
+	yamuxConf := yamux.DefaultConfig()
+	yamuxConf.AcceptBacklog = cfg.AcceptBacklog
+	yamuxConf.EnableKeepAlive = cfg.EnableKeepAlive
+	yamuxConf.KeepAliveInterval = time.Duration(cfg.KeepAliveInterval) * time.Millisecond
+	yamuxConf.ConnectionWriteTimeout = time.Duration(cfg.ConnectionWriteTimeout) * time.Millisecond
+	if cfg.MaxStreamWindowSize > 0 {
+		yamuxConf.MaxStreamWindowSize = cfg.MaxStreamWindowSize
+	}
+	return yamuxConf
+}
+
+// yamuxSessionAdapter adapts *yamux.Session's concretely-typed stream
+// methods to the generic Session interface.
+type yamuxSessionAdapter struct{ s *yamux.Session }
+
+func (a yamuxSessionAdapter) OpenStream() (net.Conn, error)   { return a.s.OpenStream() }
+func (a yamuxSessionAdapter) AcceptStream() (net.Conn, error) { return a.s.AcceptStream() }
+func (a yamuxSessionAdapter) Close() error                    { return a.s.Close() }
+func (a yamuxSessionAdapter) IsClosed() bool                  { return a.s.IsClosed() }
+func (a yamuxSessionAdapter) Ping() (time.Duration, error)    { return a.s.Ping() }
+
+// --- tcp-yamux ---------------------------------------------------------
+
+// tcpYamuxWire is the original transport: a TCP dial (optionally wrapped
+// by a Transport, see transport.go), the authentication handshake (legacy
+// RSA token or noise-ik, see handshake.go), an optional multiConn carrier
+// pool, and a yamux session on top.
+type tcpYamuxWire struct{}
+
+func (tcpYamuxWire) Dial(ctx context.Context, addr string, cfg *Config) (Session, io.Closer, error) {
+	transport, err := newTransport(cfg.Transport)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tunnelConn net.Conn
+	var sessionKey []byte
+	switch {
+	case cfg.Transport == "tls-mimic":
+		// tls-mimic already authenticates as part of its handshake, so
+		// skip the separate exchange entirely.
+		tunnelConn, err = transport.DialTunnel(ctx, addr, cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+	case cfg.Handshake == "noise-ik":
+		tunnelConn, err = dialNoiseIK(ctx, addr, cfg, transport)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Println("Authenticated to server via noise-ik")
+	default:
+		tunnelConn, err = transport.DialTunnel(ctx, addr, cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		sessionKey, err = dialLegacyToken(tunnelConn, cfg)
+		if err != nil {
+			tunnelConn.Close()
+			return nil, nil, err
+		}
+	}
+
+	var muxConn net.Conn = tunnelConn
+	if cfg.Yamux.NumConn > 1 {
+		switch {
+		case cfg.Transport != "" && cfg.Transport != "raw":
+			log.Printf("yamux.numConn > 1 is only supported with the raw transport; continuing with a single connection")
+		case cfg.Handshake == "noise-ik":
+			// The extra carriers dialed below are plaintext TCP sockets;
+			// striping them alongside a noise-ik-secured socket 0 would
+			// put most yamux frames on the wire in the clear. Refuse
+			// rather than silently defeat the handshake's confidentiality.
+			log.Printf("yamux.numConn > 1 is not supported with the noise-ik handshake; continuing with a single connection")
+		default:
+			extraConns, err := dialMultiConnSockets(addr, cfg.Yamux.NumConn-1, sessionKey)
+			if err != nil {
+				tunnelConn.Close()
+				return nil, nil, fmt.Errorf("failed to dial additional carrier connections: %w", err)
+			}
+			muxConn = newMultiConn(append([]net.Conn{tunnelConn}, extraConns...))
+			log.Printf("Dialed %d parallel carrier connections", cfg.Yamux.NumConn)
+		}
+	}
+
+	session, err := yamux.Client(muxConn, buildYamuxConfig(cfg.Yamux))
+	if err != nil {
+		muxConn.Close()
+		return nil, nil, err
+	}
+	return yamuxSessionAdapter{session}, muxConn, nil
+}
+
+// dialLegacyToken performs the legacy RSA-PKCS1v15 token handshake write
+// side: the version byte, the encrypted token, then a freshly generated
+// session key (also RSA-sealed, in its own block). The returned session
+// key is never sent in the clear, so it doubles as the per-session secret
+// dialMultiConnSockets binds extra carriers to (see multiconn.go).
+func dialLegacyToken(conn net.Conn, cfg *Config) ([]byte, error) {
+	publicKey, err := loadPublicKey(cfg.PublicKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	encToken, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, []byte(cfg.SecretToken))
+	if err != nil {
+		err = fmt.Errorf("failed to encrypt token: %w", err)
+		recordHandshakeFailure("encrypt_token", err)
+		return nil, err
+	}
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		return nil, fmt.Errorf("failed to generate session key: %w", err)
+	}
+	encSessionKey, err := rsa.EncryptPKCS1v15(rand.Reader, publicKey, sessionKey)
+	if err != nil {
+		err = fmt.Errorf("failed to encrypt session key: %w", err)
+		recordHandshakeFailure("encrypt_session_key", err)
+		return nil, err
+	}
+	msg := append([]byte{handshakeVersionLegacy}, encToken...)
+	msg = append(msg, encSessionKey...)
+	if _, err := conn.Write(msg); err != nil {
+		err = fmt.Errorf("failed to send encrypted token: %w", err)
+		recordHandshakeFailure("send_token", err)
+		return nil, err
+	}
+	log.Println("Sent encrypted token to server for authentication")
+	return sessionKey, nil
+}
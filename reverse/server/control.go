@@ -0,0 +1,346 @@
+// control.go
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The client, not the server config, declares which remote ports should be
+// exposed (chisel/frp-style remote forwarding). Messages are exchanged as
+// length-prefixed JSON over a dedicated yamux control stream, which is the
+// first stream opened on the session. Each subsequent data stream is
+// prefixed with a 4-byte listenerID so it can be routed to the right
+// listener.
+
+// ControlMessageType identifies the payload carried by a ControlMessage.
+type ControlMessageType string
+
+const (
+	MsgOpenListener   ControlMessageType = "open_listener"
+	MsgCloseListener  ControlMessageType = "close_listener"
+	MsgListenerOpened ControlMessageType = "listener_opened"
+	MsgStats          ControlMessageType = "stats"
+	MsgPing           ControlMessageType = "ping"
+	MsgPong           ControlMessageType = "pong"
+)
+
+// ControlMessage is the envelope sent over the control stream; exactly one
+// of the payload fields is populated, matching Type.
+type ControlMessage struct {
+	Type           ControlMessageType `json:"type"`
+	OpenListener   *OpenListenerMsg   `json:"openListener,omitempty"`
+	CloseListener  *CloseListenerMsg  `json:"closeListener,omitempty"`
+	ListenerOpened *ListenerOpenedMsg `json:"listenerOpened,omitempty"`
+	Stats          *StatsMsg          `json:"stats,omitempty"`
+}
+
+type OpenListenerMsg struct {
+	ID       uint32 `json:"id"`
+	BindAddr string `json:"bindAddr"`
+	Proto    string `json:"proto"`
+}
+
+type CloseListenerMsg struct {
+	ID uint32 `json:"id"`
+}
+
+type ListenerOpenedMsg struct {
+	ID         uint32 `json:"id"`
+	ActualAddr string `json:"actualAddr"`
+	Error      string `json:"error,omitempty"`
+}
+
+type StatsMsg struct {
+	ID          uint32 `json:"id"`
+	BytesIn     int64  `json:"bytesIn"`
+	BytesOut    int64  `json:"bytesOut"`
+	ActiveConns int32  `json:"activeConns"`
+}
+
+// listenerIDHeaderLen is the size of the listenerID header prepended to
+// every data stream opened in response to a user connection.
+const listenerIDHeaderLen = 4
+
+func writeControlMessage(w io.Writer, msg *ControlMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(body)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+func readControlMessage(r io.Reader) (*ControlMessage, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	var msg ControlMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func writeListenerID(w io.Writer, id uint32) error {
+	header := make([]byte, listenerIDHeaderLen)
+	binary.BigEndian.PutUint32(header, id)
+	_, err := w.Write(header)
+	return err
+}
+
+func readListenerID(r io.Reader) (uint32, error) {
+	header := make([]byte, listenerIDHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(header), nil
+}
+
+// dynamicListener tracks one listener opened on demand for a client.
+type dynamicListener struct {
+	id          uint32
+	bindAddr    string
+	listener    net.Listener
+	bytesIn     int64
+	bytesOut    int64
+	activeConns int32
+}
+
+// controlPlane manages the listeners a single client session has asked the
+// server to publish.
+type controlPlane struct {
+	session Session
+	cfg     *Config
+
+	mu        sync.Mutex
+	listeners map[uint32]*dynamicListener
+
+	writeMu sync.Mutex
+}
+
+// send writes a control message, serializing against concurrent senders
+// (the read loop and the stats ticker both write to the same stream).
+func (cp *controlPlane) send(stream io.Writer, msg *ControlMessage) error {
+	cp.writeMu.Lock()
+	defer cp.writeMu.Unlock()
+	return writeControlMessage(stream, msg)
+}
+
+// pushStats periodically reports byte/connection counters for every
+// listener still open, until done is closed.
+func (cp *controlPlane) pushStats(stream io.Writer, done <-chan struct{}) {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			cp.mu.Lock()
+			snapshot := make([]*dynamicListener, 0, len(cp.listeners))
+			for _, dl := range cp.listeners {
+				snapshot = append(snapshot, dl)
+			}
+			cp.mu.Unlock()
+			for _, dl := range snapshot {
+				stats := &StatsMsg{
+					ID:          dl.id,
+					BytesIn:     atomic.LoadInt64(&dl.bytesIn),
+					BytesOut:    atomic.LoadInt64(&dl.bytesOut),
+					ActiveConns: atomic.LoadInt32(&dl.activeConns),
+				}
+				if err := cp.send(stream, &ControlMessage{Type: MsgStats, Stats: stats}); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+// runControlPlane opens the reserved control stream and serves OpenListener/
+// CloseListener/Ping requests from the client until the session ends. It
+// blocks for the life of the session.
+func runControlPlane(session Session, cfg *Config) error {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return fmt.Errorf("control: failed to open control stream: %w", err)
+	}
+	defer stream.Close()
+
+	cp := &controlPlane{session: session, cfg: cfg, listeners: make(map[uint32]*dynamicListener)}
+	defer cp.closeAll()
+
+	statsDone := make(chan struct{})
+	defer close(statsDone)
+	go cp.pushStats(stream, statsDone)
+
+	for {
+		msg, err := readControlMessage(stream)
+		if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case MsgOpenListener:
+			cp.handleOpenListener(stream, msg.OpenListener)
+		case MsgCloseListener:
+			cp.handleCloseListener(msg.CloseListener)
+		case MsgPing:
+			cp.send(stream, &ControlMessage{Type: MsgPong})
+		default:
+			log.Printf("control: ignoring unexpected message type %q", msg.Type)
+		}
+	}
+}
+
+func (cp *controlPlane) handleOpenListener(stream io.Writer, req *OpenListenerMsg) {
+	reply := ListenerOpenedMsg{ID: req.ID}
+	if !bindAddrAllowed(req.BindAddr, cp.cfg.AllowedBindRanges) {
+		reply.Error = fmt.Sprintf("bind address %s not allowed", req.BindAddr)
+		cp.send(stream, &ControlMessage{Type: MsgListenerOpened, ListenerOpened: &reply})
+		return
+	}
+	l, err := net.Listen("tcp", req.BindAddr)
+	if err != nil {
+		reply.Error = err.Error()
+		cp.send(stream, &ControlMessage{Type: MsgListenerOpened, ListenerOpened: &reply})
+		return
+	}
+	dl := &dynamicListener{id: req.ID, bindAddr: req.BindAddr, listener: l}
+	cp.mu.Lock()
+	cp.listeners[req.ID] = dl
+	cp.mu.Unlock()
+
+	reply.ActualAddr = l.Addr().String()
+	if err := cp.send(stream, &ControlMessage{Type: MsgListenerOpened, ListenerOpened: &reply}); err != nil {
+		l.Close()
+		return
+	}
+	log.Printf("control: opened listener %d on %s for client", req.ID, reply.ActualAddr)
+	go cp.acceptLoop(dl)
+}
+
+func (cp *controlPlane) handleCloseListener(req *CloseListenerMsg) {
+	cp.mu.Lock()
+	dl, ok := cp.listeners[req.ID]
+	if ok {
+		delete(cp.listeners, req.ID)
+	}
+	cp.mu.Unlock()
+	if ok {
+		dl.listener.Close()
+		log.Printf("control: closed listener %d", req.ID)
+	}
+}
+
+func (cp *controlPlane) closeAll() {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	for id, dl := range cp.listeners {
+		dl.listener.Close()
+		delete(cp.listeners, id)
+	}
+}
+
+// acceptLoop accepts user connections on a dynamically opened listener and
+// demuxes each one to the client over a new data stream tagged with the
+// listener's ID.
+func (cp *controlPlane) acceptLoop(dl *dynamicListener) {
+	for {
+		userConn, err := dl.listener.Accept()
+		if err != nil {
+			return
+		}
+		log.Printf("control: accepted connection on listener %d", dl.id)
+		userConnectionsTotal.WithLabelValues(dl.bindAddr).Inc()
+		go func(userConn net.Conn) {
+			defer userConn.Close()
+			stream, err := cp.session.OpenStream()
+			if err != nil {
+				log.Printf("control: failed to open data stream for listener %d: %v", dl.id, err)
+				return
+			}
+			defer stream.Close()
+			if err := writeListenerID(stream, dl.id); err != nil {
+				log.Printf("control: failed to write listener header: %v", err)
+				return
+			}
+			atomic.AddInt32(&dl.activeConns, 1)
+			defer atomic.AddInt32(&dl.activeConns, -1)
+			streamsOpen.Inc()
+			defer streamsOpen.Dec()
+			handleMeteredStream(userConn, stream, &dl.bytesIn, &dl.bytesOut)
+		}(userConn)
+	}
+}
+
+// handleMeteredStream is handleStream plus byte counters, used by the
+// dynamic control plane to populate Stats messages.
+func handleMeteredStream(userConn net.Conn, stream net.Conn, bytesIn, bytesOut *int64) {
+	defer userConn.Close()
+	defer stream.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		n, _ := copyBuffer(stream, userConn, "in")
+		atomic.AddInt64(bytesOut, n)
+	}()
+
+	go func() {
+		defer wg.Done()
+		n, _ := copyBuffer(userConn, stream, "out")
+		atomic.AddInt64(bytesIn, n)
+	}()
+
+	wg.Wait()
+}
+
+// bindAddrAllowed reports whether addr's host falls within one of the
+// configured CIDR ranges. An empty allowlist permits everything, matching
+// the previous behavior where UserListenAddr was trusted outright.
+func bindAddrAllowed(addr string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	for _, rangeStr := range allowed {
+		if !strings.Contains(rangeStr, "/") {
+			if host == rangeStr {
+				return true
+			}
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(rangeStr)
+		if err != nil {
+			continue
+		}
+		if ip != nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
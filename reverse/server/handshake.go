@@ -0,0 +1,230 @@
+// handshake.go
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/flynn/noise"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Handshake version byte. Both the legacy RSA-PKCS1v15 token exchange and
+// the noise-ik handshake below send this as the very first byte of the
+// tunnel connection, so a server with both kinds of client still attached
+// can tell which one it's talking to before reading anything else.
+const (
+	handshakeVersionLegacy  byte = 0x01
+	handshakeVersionNoiseIK byte = 0x02
+)
+
+var noiseCipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashSHA256)
+
+// Message lengths for the Noise IK pattern ("-> e, es, s, ss" then
+// "<- e, ee, se") with an empty payload on both messages: message 1 is an
+// unencrypted ephemeral key, the initiator's static key sealed with its
+// own tag, and then the AEAD tag WriteMessage always appends for the
+// (here empty) payload once a key exists; message 2 is the responder's
+// ephemeral key plus that same trailing empty-payload tag.
+const (
+	noiseMsg1Len = 32 + (32 + 16) + 16
+	noiseMsg2Len = 32 + 16
+)
+
+// noisePrologue derives the Noise prologue from the shared SecretToken, so
+// a client that doesn't know the token produces a different transcript
+// hash and fails the handshake MAC even if it holds a valid static
+// keypair of its own.
+func noisePrologue(secretToken string) []byte {
+	h := sha256.Sum256([]byte("tunnelengine-noise-ik|" + secretToken))
+	return h[:]
+}
+
+// decodeCurve25519Key parses a static private key file holding either the
+// raw 32-byte key or its 64-character hex encoding, and derives the
+// matching public key.
+func decodeCurve25519Key(raw []byte) (noise.DHKey, error) {
+	raw = bytes.TrimSpace(raw)
+	priv := make([]byte, 32)
+	switch len(raw) {
+	case 32:
+		copy(priv, raw)
+	case 64:
+		if _, err := hex.Decode(priv, raw); err != nil {
+			return noise.DHKey{}, errors.New("expected 32 raw or 64 hex-encoded bytes")
+		}
+	default:
+		return noise.DHKey{}, errors.New("expected 32 raw or 64 hex-encoded bytes")
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return noise.DHKey{}, err
+	}
+	return noise.DHKey{Private: priv, Public: pub}, nil
+}
+
+// loadNoiseStaticKeys reads this server's Curve25519 static private keys,
+// newest first, for the noise-ik handshake. Keeping several lets an
+// operator prepend a new key here and roll clients onto it before
+// retiring the old one (left in place further down the list), with no
+// restart-synchronized downtime.
+func loadNoiseStaticKeys(paths []string) ([]noise.DHKey, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("noise-ik: no noiseStaticKeyPaths configured")
+	}
+	keys := make([]noise.DHKey, 0, len(paths))
+	for _, p := range paths {
+		raw, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("noise-ik: reading static key %s: %w", p, err)
+		}
+		key, err := decodeCurve25519Key(raw)
+		if err != nil {
+			return nil, fmt.Errorf("noise-ik: static key %s: %w", p, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// acceptNoiseIK runs the responder side of the Noise IK handshake over
+// conn, after the caller has already consumed the version byte. It tries
+// each of cfg.NoiseStaticKeyPaths in turn, since it has no way to know in
+// advance which one the client dialed against during a key-rotation
+// window, and returns conn wrapped in per-session ChaCha20-Poly1305
+// framing.
+func acceptNoiseIK(conn net.Conn, cfg *Config) (net.Conn, error) {
+	staticKeys, err := loadNoiseStaticKeys(cfg.NoiseStaticKeyPaths)
+	if err != nil {
+		return nil, err
+	}
+	msg1 := make([]byte, noiseMsg1Len)
+	if _, err := io.ReadFull(conn, msg1); err != nil {
+		err = fmt.Errorf("noise-ik: failed to read handshake message 1: %w", err)
+		recordHandshakeFailure("noise_read_msg1", err)
+		return nil, err
+	}
+	// A client still on the previous SecretToken (see Server.reload) hashes
+	// that token into its prologue instead, so try it too while its grace
+	// window is open.
+	prologues := [][]byte{noisePrologue(cfg.SecretToken)}
+	if cfg.previousSecretToken != "" && time.Now().Before(cfg.previousTokenDeadline) {
+		prologues = append(prologues, noisePrologue(cfg.previousSecretToken))
+	}
+	var lastErr error
+	for i := 0; i < len(prologues)*len(staticKeys); i++ {
+		prologue, sk := prologues[i/len(staticKeys)], staticKeys[i%len(staticKeys)]
+		hs, err := noise.NewHandshakeState(noise.Config{
+			CipherSuite:   noiseCipherSuite,
+			Random:        rand.Reader,
+			Pattern:       noise.HandshakeIK,
+			Initiator:     false,
+			Prologue:      prologue,
+			StaticKeypair: sk,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, _, _, err := hs.ReadMessage(nil, msg1); err != nil {
+			lastErr = err
+			continue
+		}
+		msg2, cs0, cs1, err := hs.WriteMessage(nil, nil)
+		if err != nil {
+			err = fmt.Errorf("noise-ik: failed to build handshake message 2: %w", err)
+			recordHandshakeFailure("noise_write_msg2", err)
+			return nil, err
+		}
+		if _, err := conn.Write(msg2); err != nil {
+			return nil, fmt.Errorf("noise-ik: failed to send handshake message 2: %w", err)
+		}
+		return newNoiseFramedConn(conn, cs0, cs1, true), nil
+	}
+	err = fmt.Errorf("noise-ik: handshake failed against all configured static keys: %w", lastErr)
+	recordHandshakeFailure("noise_invalid_client", err)
+	return nil, err
+}
+
+// noiseFramedConn wraps a net.Conn, post-handshake, with per-session
+// ChaCha20-Poly1305 framing: each record is a 2-byte big-endian length
+// (of the sealed payload, 16-byte tag included) followed by the sealed
+// bytes themselves. The nonce is the noise.CipherState's own monotonic
+// counter, so there's no separate sequence number to track here.
+type noiseFramedConn struct {
+	net.Conn
+	writeCipher, readCipher *noise.CipherState
+	writeMu, readMu         sync.Mutex
+	readBuf                 []byte
+}
+
+// noiseFrameMaxPlaintext keeps each record's sealed length comfortably
+// under the 2-byte length prefix's 65535-byte ceiling.
+const noiseFrameMaxPlaintext = 16 * 1024
+
+func newNoiseFramedConn(conn net.Conn, cs0, cs1 *noise.CipherState, isServer bool) *noiseFramedConn {
+	c := &noiseFramedConn{Conn: conn}
+	if isServer {
+		c.readCipher, c.writeCipher = cs0, cs1
+	} else {
+		c.writeCipher, c.readCipher = cs0, cs1
+	}
+	return c
+}
+
+func (c *noiseFramedConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	total := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > noiseFrameMaxPlaintext {
+			chunk = chunk[:noiseFrameMaxPlaintext]
+		}
+		sealed, err := c.writeCipher.Encrypt(nil, nil, chunk)
+		if err != nil {
+			return total, fmt.Errorf("noise-ik: failed to seal record: %w", err)
+		}
+		frame := make([]byte, 2+len(sealed))
+		binary.BigEndian.PutUint16(frame, uint16(len(sealed)))
+		copy(frame[2:], sealed)
+		if _, err := c.Conn.Write(frame); err != nil {
+			return total, err
+		}
+		total += len(chunk)
+		p = p[len(chunk):]
+	}
+	return total, nil
+}
+
+func (c *noiseFramedConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.readBuf) == 0 {
+		lenHeader := make([]byte, 2)
+		if _, err := io.ReadFull(c.Conn, lenHeader); err != nil {
+			return 0, err
+		}
+		sealed := make([]byte, binary.BigEndian.Uint16(lenHeader))
+		if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+			return 0, err
+		}
+		plain, err := c.readCipher.Decrypt(nil, nil, sealed)
+		if err != nil {
+			return 0, fmt.Errorf("noise-ik: failed to open record: %w", err)
+		}
+		c.readBuf = plain
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
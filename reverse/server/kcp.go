@@ -0,0 +1,225 @@
+// kcp.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+)
+
+// handshakeIDLen is the size of the random, non-secret identifier a
+// client sends alongside its RSA token over the TCP handshake and again
+// as the first bytes of the KCP connection that follows. maxKCPAcceptAttempts
+// bounds how many non-matching KCP connections kcpSmuxListener.Accept will
+// discard before giving up on ever seeing its own.
+const (
+	handshakeIDLen       = 16
+	maxKCPAcceptAttempts = 32
+)
+
+// KCPConfig tunes the KCP session used by the kcp-smux wire. See
+// xtaci/kcp-go's ReadConfig/NoDelay docs for the meaning of each field;
+// zero values fall back to kcp-go's own defaults.
+type KCPConfig struct {
+	DataShards   int `json:"dataShards"`
+	ParityShards int `json:"parityShards"`
+	NoDelay      int `json:"noDelay"`
+	Interval     int `json:"interval"`
+	Resend       int `json:"resend"`
+	NC           int `json:"nc"`
+	SndWnd       int `json:"sndWnd"`
+	RcvWnd       int `json:"rcvWnd"`
+	MTU          int `json:"mtu"`
+}
+
+// kcpSessionAdapter adapts *smux.Session's concretely-typed stream methods
+// to the generic Session interface.
+type kcpSessionAdapter struct{ s *smux.Session }
+
+func (a kcpSessionAdapter) OpenStream() (net.Conn, error)   { return a.s.OpenStream() }
+func (a kcpSessionAdapter) AcceptStream() (net.Conn, error) { return a.s.AcceptStream() }
+func (a kcpSessionAdapter) Close() error                    { return a.s.Close() }
+func (a kcpSessionAdapter) IsClosed() bool                  { return a.s.IsClosed() }
+
+// Ping is unsupported: smux, unlike yamux, doesn't expose a keepalive RTT
+// probe. pingLoop (see metrics.go) treats this error as "stop sampling"
+// rather than retrying forever.
+func (a kcpSessionAdapter) Ping() (time.Duration, error) {
+	return 0, errors.New("kcp-smux: session does not support Ping")
+}
+
+// kcpSmuxWire runs the tunnel over KCP (with Reed-Solomon FEC) instead of
+// raw TCP, and smux instead of yamux on top. The RSA token handshake still
+// runs first, over a short TCP connection on the same address, and the
+// session key it negotiates is reused to AEAD-wrap the KCP connection
+// before smux sees it.
+type kcpSmuxWire struct{}
+
+// kcpSmuxListener reuses one TCP listener for the handshake and one UDP
+// socket (opened lazily, since it must outlive any single client) for the
+// KCP sessions that follow.
+type kcpSmuxListener struct {
+	tcpListener net.Listener
+
+	mu                 sync.Mutex
+	kcpListener        *kcp.Listener
+	pendingHandshakeID []byte // set while one TCP handshake is waiting for its matching KCP connection
+}
+
+func (kcpSmuxWire) Listen(cfg *Config) (WireListener, error) {
+	l, err := net.Listen("tcp", cfg.TunnelListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &kcpSmuxListener{tcpListener: l}, nil
+}
+
+func (kl *kcpSmuxListener) Close() error {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	if kl.kcpListener != nil {
+		kl.kcpListener.Close()
+	}
+	return kl.tcpListener.Close()
+}
+
+func (kl *kcpSmuxListener) Accept(ctx context.Context, cfg *Config) (Session, io.Closer, error) {
+	handshakeConn, err := kl.tcpListener.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer handshakeConn.Close()
+
+	privateKey, err := loadPrivateKey(cfg.PrivateKeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The handshake packet is the RSA-encrypted token, a 32-byte session
+	// key the client generated (used below to AEAD-wrap the KCP
+	// connection), and a handshakeID the client will send again as the
+	// first bytes of that KCP connection.
+	buf := make([]byte, 256+32+handshakeIDLen)
+	if _, err := io.ReadFull(handshakeConn, buf); err != nil {
+		return nil, nil, fmt.Errorf("kcp-smux: failed to read handshake packet: %w", err)
+	}
+	plain, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, buf[:256])
+	if err != nil {
+		err = fmt.Errorf("kcp-smux: failed to decrypt handshake token: %w", err)
+		recordHandshakeFailure("decrypt_token", err)
+		return nil, nil, err
+	}
+	if !validToken(cfg, string(plain)) {
+		err := fmt.Errorf("kcp-smux: invalid token from client")
+		recordHandshakeFailure("invalid_token", err)
+		return nil, nil, err
+	}
+	sessionKey := append([]byte(nil), buf[256:256+32]...)
+	handshakeID := append([]byte(nil), buf[256+32:]...)
+
+	// Only one TCP handshake may be waiting for its KCP connection at a
+	// time: AcceptKCP below has no way to hand a non-matching connection
+	// off to a different pending handshake, so a second one arriving here
+	// while the first is still unmatched would just add another way for
+	// the two to be crossed. Reject it outright instead.
+	kl.mu.Lock()
+	if kl.pendingHandshakeID != nil {
+		kl.mu.Unlock()
+		err := errors.New("kcp-smux: another handshake is already waiting for its KCP connection")
+		recordHandshakeFailure("kcp_handshake_busy", err)
+		return nil, nil, err
+	}
+	kl.pendingHandshakeID = handshakeID
+	kl.mu.Unlock()
+	defer func() {
+		kl.mu.Lock()
+		kl.pendingHandshakeID = nil
+		kl.mu.Unlock()
+	}()
+
+	if _, err := handshakeConn.Write([]byte{0x01}); err != nil {
+		return nil, nil, fmt.Errorf("kcp-smux: failed to ack handshake: %w", err)
+	}
+	log.Println("Client authenticated successfully over kcp-smux handshake")
+
+	kl.mu.Lock()
+	if kl.kcpListener == nil {
+		kcpListener, err := kcp.ListenWithOptions(cfg.TunnelListenAddr, nil, cfg.KCP.DataShards, cfg.KCP.ParityShards)
+		if err != nil {
+			kl.mu.Unlock()
+			return nil, nil, fmt.Errorf("kcp-smux: failed to listen: %w", err)
+		}
+		kl.kcpListener = kcpListener
+	}
+	kcpListener := kl.kcpListener
+	kl.mu.Unlock()
+
+	kcpConn, err := acceptMatchingKCPConn(kcpListener, handshakeID)
+	if err != nil {
+		return nil, nil, err
+	}
+	applyKCPTuning(kcpConn, &cfg.KCP)
+
+	aead, err := newAEADFromKey(sessionKey)
+	if err != nil {
+		kcpConn.Close()
+		return nil, nil, err
+	}
+	secureConn := newAEADConn(kcpConn, aead, true)
+
+	smuxConf := smux.DefaultConfig()
+	session, err := smux.Server(secureConn, smuxConf)
+	if err != nil {
+		kcpConn.Close()
+		return nil, nil, err
+	}
+	return kcpSessionAdapter{session}, kcpConn, nil
+}
+
+// acceptMatchingKCPConn accepts KCP connections on l until one leads with
+// wantID, discarding any that don't: with the shared UDP listener, a
+// connection left over from an earlier aborted attempt could otherwise be
+// accepted here instead of the one this handshake is actually waiting
+// for.
+func acceptMatchingKCPConn(l *kcp.Listener, wantID []byte) (*kcp.UDPSession, error) {
+	for attempt := 0; attempt < maxKCPAcceptAttempts; attempt++ {
+		conn, err := l.AcceptKCP()
+		if err != nil {
+			return nil, fmt.Errorf("kcp-smux: failed to accept KCP session: %w", err)
+		}
+		gotID := make([]byte, handshakeIDLen)
+		if _, err := io.ReadFull(conn, gotID); err != nil {
+			conn.Close()
+			continue
+		}
+		if !bytes.Equal(gotID, wantID) {
+			log.Printf("kcp-smux: rejecting KCP connection with mismatched handshake id")
+			conn.Close()
+			continue
+		}
+		return conn, nil
+	}
+	return nil, fmt.Errorf("kcp-smux: gave up after %d non-matching KCP connections", maxKCPAcceptAttempts)
+}
+
+func applyKCPTuning(conn *kcp.UDPSession, cfg *KCPConfig) {
+	if cfg.NoDelay != 0 || cfg.Interval != 0 || cfg.Resend != 0 || cfg.NC != 0 {
+		conn.SetNoDelay(cfg.NoDelay, cfg.Interval, cfg.Resend, cfg.NC)
+	}
+	if cfg.SndWnd > 0 || cfg.RcvWnd > 0 {
+		conn.SetWindowSize(cfg.SndWnd, cfg.RcvWnd)
+	}
+	if cfg.MTU > 0 {
+		conn.SetMtu(cfg.MTU)
+	}
+}
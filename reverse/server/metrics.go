@@ -0,0 +1,99 @@
+// metrics.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// log is shared by every file in this package; it replaces the stdlib
+// log package so messages get levels, timestamps and (optionally)
+// structured fields instead of bare Printf text.
+var log = logrus.New()
+
+var (
+	sessionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tunnel_sessions_active",
+		Help: "Number of tunnel client sessions currently connected.",
+	})
+	streamsOpen = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "tunnel_streams_open",
+		Help: "Number of streams currently open between the server and the tunnel client.",
+	})
+	streamBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnel_stream_bytes_total",
+		Help: "Bytes relayed between external clients and the tunnel, by direction.",
+	}, []string{"direction"})
+	handshakeFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tunnel_handshake_failures_total",
+		Help: "Tunnel handshake failures, by reason.",
+	}, []string{"reason"})
+	acceptErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "tunnel_accept_errors_total",
+		Help: "Errors accepting a tunnel client connection.",
+	})
+	userConnectionsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "user_connections_total",
+		Help: "External client connections accepted, by listen address.",
+	}, []string{"listen_addr"})
+	pingRTT = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "yamux_ping_rtt_seconds",
+		Help:    "Round-trip time of periodic session.Ping() probes.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// serveMetrics runs the Prometheus /metrics endpoint on addr until ctx is
+// canceled. It mirrors serveAdmin's shape (see reload.go).
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	httpServer := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.WithError(err).Error("metrics endpoint failed")
+	}
+}
+
+// recordHandshakeFailure increments tunnel_handshake_failures_total for
+// reason and logs it at warn level; callers pass their wrapped error so the
+// log line stays specific while the metric label stays low-cardinality.
+func recordHandshakeFailure(reason string, err error) {
+	handshakeFailuresTotal.WithLabelValues(reason).Inc()
+	log.WithError(err).WithField("reason", reason).Warn("tunnel handshake failed")
+}
+
+// pingLoop samples session RTT via session.Ping() every interval, feeding
+// successful probes into pingRTT and the log, until stop is closed or the
+// session reports closed. Sessions that don't support Ping (smux, see
+// kcp.go) log once and return instead of busy-looping on the same error.
+func pingLoop(session Session, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if session.IsClosed() {
+				return
+			}
+			rtt, err := session.Ping()
+			if err != nil {
+				log.WithError(err).Debug("session ping failed")
+				return
+			}
+			pingRTT.Observe(rtt.Seconds())
+			log.WithField("rtt", rtt).Debug("session ping")
+		}
+	}
+}
@@ -0,0 +1,288 @@
+// multiconn.go
+package main
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxMultiConnAcceptAttempts bounds how many stray connections
+// acceptMultiConnSockets will reject and retry past before giving up on
+// ever assembling this session's carrier pool.
+const maxMultiConnAcceptAttempts = 32
+
+// multiConnSessionIDLen is the size of the public, non-secret session
+// identifier an additional socket leads with, so the server can reject a
+// socket meant for a different session before it even checks the HMAC.
+const multiConnSessionIDLen = 8
+
+// multiConnAuthLen is the size of the sessionID+nonce+HMAC an additional
+// socket sends to prove it belongs to the same authenticated session as
+// socket 0.
+const multiConnAuthLen = multiConnSessionIDLen + 16 + sha256.Size
+
+// multiConnKey derives the MAC key used to authenticate additional
+// sockets from sessionKey, the per-session secret the client generated
+// and RSA-sealed during socket 0's handshake (see authenticateLegacyToken).
+// Keying off the session rather than the long-lived SecretToken means a
+// blob captured off the wire in one session can't be replayed to hijack
+// a later one.
+func multiConnKey(sessionKey []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("multiconn-key|"))
+	h.Write(sessionKey)
+	return h.Sum(nil)
+}
+
+// multiConnSessionID derives the public identifier sent alongside the
+// HMAC so the server can tell which session a carrier is joining without
+// revealing anything about sessionKey itself.
+func multiConnSessionID(sessionKey []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("multiconn-id|"))
+	h.Write(sessionKey)
+	return h.Sum(nil)[:multiConnSessionIDLen]
+}
+
+// acceptMultiConnSocket reads and verifies the sessionID+nonce+HMAC an
+// additional socket sends to prove it belongs to the session already
+// authenticated on socket 0.
+func acceptMultiConnSocket(conn net.Conn, sessionKey []byte) error {
+	buf := make([]byte, multiConnAuthLen)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	sessionID, nonce, mac := buf[:multiConnSessionIDLen], buf[multiConnSessionIDLen:multiConnSessionIDLen+16], buf[multiConnSessionIDLen+16:]
+	if !hmac.Equal(sessionID, multiConnSessionID(sessionKey)) {
+		return errors.New("multiconn: socket auth for a different session")
+	}
+	expected := hmac.New(sha256.New, multiConnKey(sessionKey))
+	expected.Write(sessionID)
+	expected.Write(nonce)
+	if !hmac.Equal(mac, expected.Sum(nil)) {
+		return errors.New("multiconn: invalid socket auth")
+	}
+	return nil
+}
+
+// acceptMultiConnSockets accepts n additional carrier connections on l for
+// the session identified by sessionKey. l is otherwise only ever used for
+// very short-lived handshakes, but nothing stops an unrelated connection
+// (a stale retry from an earlier failed attempt, a port scan) from
+// landing in this window; such a connection fails acceptMultiConnSocket's
+// sessionID check and is dropped rather than aborting the whole accept,
+// so a stray socket can't tear down the session socket 0 just finished
+// authenticating.
+func acceptMultiConnSockets(l net.Listener, n int, sessionKey []byte) ([]net.Conn, error) {
+	conns := make([]net.Conn, 0, n)
+	attempts := 0
+	for len(conns) < n {
+		conn, err := l.Accept()
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		if err := acceptMultiConnSocket(conn, sessionKey); err != nil {
+			attempts++
+			log.Printf("multiconn: rejecting stray carrier connection: %v", err)
+			conn.Close()
+			if attempts >= maxMultiConnAcceptAttempts {
+				for _, c := range conns {
+					c.Close()
+				}
+				return nil, fmt.Errorf("multiconn: gave up after %d stray connections waiting for %d carriers", attempts, n)
+			}
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// multiConn stripes a byte stream across N parallel TCP sockets so
+// throughput isn't capped by a single kernel socket's congestion window.
+// Writes are length+seq framed and round-robined across the sockets;
+// reads are reassembled in sequence order via a small priority queue, so
+// yamux still sees one ordered byte stream.
+type multiConn struct {
+	conns []net.Conn
+
+	writeSeq uint32
+	writeIdx uint32
+
+	readMu  sync.Mutex
+	nextSeq uint32
+	pending frameHeap
+	readBuf []byte
+
+	incoming  chan frame
+	readErr   error
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+type frame struct {
+	seq  uint32
+	data []byte
+}
+
+// frameHeap orders buffered frames by seq so reassembly stays correct
+// even when frames arrive out of order across sockets.
+type frameHeap []frame
+
+func (h frameHeap) Len() int            { return len(h) }
+func (h frameHeap) Less(i, j int) bool  { return h[i].seq < h[j].seq }
+func (h frameHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *frameHeap) Push(x interface{}) { *h = append(*h, x.(frame)) }
+func (h *frameHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	v := old[n-1]
+	*h = old[:n-1]
+	return v
+}
+
+func newMultiConn(conns []net.Conn) *multiConn {
+	mc := &multiConn{
+		conns:    conns,
+		incoming: make(chan frame, 64),
+		closed:   make(chan struct{}),
+	}
+	for _, c := range conns {
+		go mc.readLoop(c)
+	}
+	return mc
+}
+
+func (mc *multiConn) fail(err error) {
+	mc.closeOnce.Do(func() {
+		mc.readErr = err
+		close(mc.closed)
+	})
+}
+
+func (mc *multiConn) readLoop(c net.Conn) {
+	for {
+		header := make([]byte, 8)
+		if _, err := io.ReadFull(c, header); err != nil {
+			mc.fail(err)
+			return
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		seq := binary.BigEndian.Uint32(header[4:8])
+		data := make([]byte, length)
+		if _, err := io.ReadFull(c, data); err != nil {
+			mc.fail(err)
+			return
+		}
+		select {
+		case mc.incoming <- frame{seq: seq, data: data}:
+		case <-mc.closed:
+			return
+		}
+	}
+}
+
+// Read reassembles frames from all sockets into sequence order before
+// returning bytes to the caller (yamux).
+func (mc *multiConn) Read(p []byte) (int, error) {
+	mc.readMu.Lock()
+	defer mc.readMu.Unlock()
+	for len(mc.readBuf) == 0 {
+		if len(mc.pending) > 0 && mc.pending[0].seq == mc.nextSeq {
+			f := heap.Pop(&mc.pending).(frame)
+			mc.nextSeq++
+			mc.readBuf = f.data
+			break
+		}
+		select {
+		case f := <-mc.incoming:
+			if f.seq == mc.nextSeq {
+				mc.nextSeq++
+				mc.readBuf = f.data
+			} else {
+				heap.Push(&mc.pending, f)
+			}
+		case <-mc.closed:
+			if mc.readErr != nil {
+				return 0, mc.readErr
+			}
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, mc.readBuf)
+	mc.readBuf = mc.readBuf[n:]
+	return n, nil
+}
+
+// Write round-robins across the underlying sockets, tagging each frame
+// with a monotonic sequence number so Read can reassemble them in order.
+func (mc *multiConn) Write(p []byte) (int, error) {
+	seq := atomic.AddUint32(&mc.writeSeq, 1) - 1
+	idx := atomic.AddUint32(&mc.writeIdx, 1) - 1
+	conn := mc.conns[int(idx)%len(mc.conns)]
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(p)))
+	binary.BigEndian.PutUint32(header[4:8], seq)
+	if _, err := conn.Write(header); err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (mc *multiConn) Close() error {
+	mc.fail(nil)
+	var err error
+	for _, c := range mc.conns {
+		if cerr := c.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (mc *multiConn) LocalAddr() net.Addr  { return mc.conns[0].LocalAddr() }
+func (mc *multiConn) RemoteAddr() net.Addr { return mc.conns[0].RemoteAddr() }
+
+func (mc *multiConn) SetDeadline(t time.Time) error {
+	return mc.setDeadlines(t, t)
+}
+
+func (mc *multiConn) SetReadDeadline(t time.Time) error {
+	return mc.setDeadlines(t, time.Time{})
+}
+
+func (mc *multiConn) SetWriteDeadline(t time.Time) error {
+	return mc.setDeadlines(time.Time{}, t)
+}
+
+func (mc *multiConn) setDeadlines(r, w time.Time) error {
+	for _, c := range mc.conns {
+		if !r.IsZero() {
+			if err := c.SetReadDeadline(r); err != nil {
+				return err
+			}
+		}
+		if !w.IsZero() {
+			if err := c.SetWriteDeadline(w); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
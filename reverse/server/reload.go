@@ -0,0 +1,357 @@
+// reload.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultPingInterval is used when Config.PingInterval is unset.
+const defaultPingInterval = 30 * time.Second
+
+// Server owns the tunnel server's lifecycle: it accepts one client session
+// at a time over the configured Wire, publishes UserListenAddr listeners on
+// top of it, and supports reloading the config file (SIGHUP or POST
+// /admin/reload) without dropping that session — added addresses get new
+// listeners, removed ones drain gracefully, and SecretToken rotation keeps
+// accepting the old token for a grace window.
+type Server struct {
+	configPath string
+
+	mu        sync.Mutex
+	cfg       Config
+	session   Session
+	listeners map[string]*userListener
+}
+
+// userListener is one net.Listener published on the active session, along
+// with the in-flight stream handlers it needs to drain before closing.
+//
+// mu guards draining: acceptLoop checks it before every wg.Add, and
+// drainListener sets it before its own wg.Wait, so an Add can never start
+// after a Wait has begun observing a zero counter (which sync.WaitGroup
+// documents as misuse and can panic).
+type userListener struct {
+	addr     string
+	listener net.Listener
+	mu       sync.Mutex
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// NewServer loads the initial config from path and returns a Server ready
+// to Run.
+func NewServer(path string) (*Server, error) {
+	cfg, err := loadServerConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Server{configPath: path, cfg: cfg, listeners: make(map[string]*userListener)}, nil
+}
+
+func loadServerConfig(path string) (Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer file.Close()
+	var cfg Config
+	if err := json.NewDecoder(file).Decode(&cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// Run accepts tunnel clients in a loop until ctx is canceled, watching for
+// SIGHUP and (if AdminAddr is set) serving POST /admin/reload the whole
+// time.
+func (s *Server) Run(ctx context.Context) error {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+	defer signal.Stop(sigCh)
+
+	s.mu.Lock()
+	adminAddr := s.cfg.AdminAddr
+	metricsAddr := s.cfg.MetricsAddr
+	s.mu.Unlock()
+	if adminAddr != "" {
+		go s.serveAdmin(ctx, adminAddr)
+	}
+	if metricsAddr != "" {
+		go serveMetrics(ctx, metricsAddr)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigCh:
+				log.Println("server: SIGHUP received, reloading config")
+				if err := s.reload(); err != nil {
+					log.Printf("server: reload failed: %v", err)
+				}
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		if err := s.runOnce(ctx); err != nil {
+			log.Printf("Connection lost: %v", err)
+		}
+		log.Println("Retrying in 3 seconds...")
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// serveAdmin runs the optional admin HTTP endpoint until ctx is canceled.
+func (s *Server) serveAdmin(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := s.reload(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	httpServer := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("server: admin endpoint failed: %v", err)
+	}
+}
+
+// reload re-reads the config file and applies whatever can be applied to
+// the running session without dropping it: the UserListenAddr set and
+// SecretToken rotation. Yamux/transport/wire settings only take effect on
+// the next reconnect, since they're tied to constructing the session
+// itself.
+func (s *Server) reload() error {
+	newCfg, err := loadServerConfig(s.configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config: %w", err)
+	}
+
+	s.mu.Lock()
+	oldCfg := s.cfg
+	if newCfg.SecretToken != oldCfg.SecretToken {
+		grace := time.Duration(oldCfg.TokenRotationGrace) * time.Millisecond
+		newCfg.previousSecretToken = oldCfg.SecretToken
+		newCfg.previousTokenDeadline = time.Now().Add(grace)
+		log.Printf("server: secretToken rotated, accepting the previous token for %s", grace)
+	} else {
+		newCfg.previousSecretToken = oldCfg.previousSecretToken
+		newCfg.previousTokenDeadline = oldCfg.previousTokenDeadline
+	}
+	s.cfg = newCfg
+	session := s.session
+	s.mu.Unlock()
+
+	if session == nil {
+		// No active session yet; the new config takes effect on connect.
+		return nil
+	}
+	s.applyListenerDiff(newCfg.UserListenAddr, time.Duration(newCfg.DrainTimeout)*time.Millisecond)
+	return nil
+}
+
+// applyListenerDiff starts listeners for addresses newly present in want
+// and drains listeners for addresses no longer present, leaving the rest
+// untouched.
+func (s *Server) applyListenerDiff(want []string, drainTimeout time.Duration) {
+	wantSet := make(map[string]bool, len(want))
+	for _, addr := range want {
+		wantSet[addr] = true
+	}
+
+	s.mu.Lock()
+	var toRemove []*userListener
+	for addr, ul := range s.listeners {
+		if !wantSet[addr] {
+			toRemove = append(toRemove, ul)
+			delete(s.listeners, addr)
+		}
+	}
+	var toAdd []string
+	for addr := range wantSet {
+		if _, ok := s.listeners[addr]; !ok {
+			toAdd = append(toAdd, addr)
+		}
+	}
+	session := s.session
+	s.mu.Unlock()
+
+	for _, ul := range toRemove {
+		go s.drainListener(ul, drainTimeout)
+	}
+	for _, addr := range toAdd {
+		s.startListener(addr, session)
+	}
+}
+
+func (s *Server) startListener(addr string, session Session) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Printf("Failed to listen on %s: %v", addr, err)
+		return
+	}
+	log.Printf("Listening for external clients on %s", addr)
+	ul := &userListener{addr: addr, listener: l}
+	s.mu.Lock()
+	s.listeners[addr] = ul
+	s.mu.Unlock()
+	go s.acceptLoop(ul, session)
+}
+
+// drainListener stops accepting on ul and waits up to timeout for its
+// in-flight streams to finish before returning; streams still running past
+// the deadline are left to finish on their own.
+func (s *Server) drainListener(ul *userListener, timeout time.Duration) {
+	ul.listener.Close()
+	ul.mu.Lock()
+	ul.draining = true
+	ul.mu.Unlock()
+	log.Printf("Draining listener %s", ul.addr)
+	done := make(chan struct{})
+	go func() {
+		ul.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		log.Printf("Listener %s drained", ul.addr)
+	case <-time.After(timeout):
+		log.Printf("Listener %s drain timeout, remaining streams left to finish on their own", ul.addr)
+	}
+}
+
+// acceptLoop accepts user connections on ul and demuxes each one to the
+// client over a new stream, until ul.listener is closed.
+func (s *Server) acceptLoop(ul *userListener, session Session) {
+	for {
+		userConn, err := ul.listener.Accept()
+		if err != nil {
+			return
+		}
+		log.Println("Accepted connection from external client")
+		ul.mu.Lock()
+		if ul.draining {
+			ul.mu.Unlock()
+			userConn.Close()
+			continue
+		}
+		ul.wg.Add(1)
+		ul.mu.Unlock()
+		userConnectionsTotal.WithLabelValues(ul.addr).Inc()
+		go func(userConn net.Conn) {
+			defer ul.wg.Done()
+			defer userConn.Close()
+			stream, err := session.OpenStream()
+			if err != nil {
+				log.Printf("Failed to open stream: %v", err)
+				return
+			}
+			streamsOpen.Inc()
+			defer streamsOpen.Dec()
+			handleStream(userConn, stream)
+		}(userConn)
+	}
+}
+
+// runOnce accepts one tunnel client, serves it (either the control plane
+// or a static UserListenAddr set) until the session ends, and tears down
+// whatever it started. It blocks for the life of one session.
+func (s *Server) runOnce(ctx context.Context) error {
+	s.mu.Lock()
+	cfg := s.cfg
+	s.mu.Unlock()
+
+	wire, err := newWire(cfg.Wire)
+	if err != nil {
+		return fmt.Errorf("invalid wire: %w", err)
+	}
+	wireListener, err := wire.Listen(&cfg)
+	if err != nil {
+		return fmt.Errorf("failed to start wire listener: %w", err)
+	}
+	defer wireListener.Close()
+
+	log.Println("Waiting for tunnel client...")
+	session, carrier, err := wireListener.Accept(ctx, &cfg)
+	if err != nil {
+		acceptErrorsTotal.Inc()
+		return fmt.Errorf("failed to accept tunnel client: %w", err)
+	}
+	log.Println("Tunnel client connected")
+	defer carrier.Close()
+	defer session.Close()
+
+	sessionsActive.Inc()
+	defer sessionsActive.Dec()
+
+	pingInterval := defaultPingInterval
+	if cfg.PingInterval > 0 {
+		pingInterval = time.Duration(cfg.PingInterval) * time.Millisecond
+	}
+	pingStop := make(chan struct{})
+	defer close(pingStop)
+	go pingLoop(session, pingInterval, pingStop)
+
+	s.mu.Lock()
+	s.session = session
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.session = nil
+		for addr, ul := range s.listeners {
+			ul.listener.Close()
+			delete(s.listeners, addr)
+		}
+		s.mu.Unlock()
+	}()
+
+	if len(cfg.UserListenAddr) == 0 {
+		return runControlPlane(session, &cfg)
+	}
+
+	for _, addr := range cfg.UserListenAddr {
+		s.startListener(addr, session)
+	}
+	s.mu.Lock()
+	noListeners := len(s.listeners) == 0
+	s.mu.Unlock()
+	if noListeners {
+		return fmt.Errorf("no user listeners available")
+	}
+
+	// Block until the session dies; reload() keeps s.listeners in sync
+	// with the config in the meantime.
+	for !session.IsClosed() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return fmt.Errorf("session closed")
+}
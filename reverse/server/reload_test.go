@@ -0,0 +1,130 @@
+// reload_test.go
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSession is a minimal Session that hands out net.Pipe streams and
+// lets the test hold onto the far end, so a stream can be kept "open"
+// (neither side closed) for as long as the test wants.
+type fakeSession struct {
+	mu      sync.Mutex
+	streams []net.Conn
+}
+
+func (f *fakeSession) OpenStream() (net.Conn, error) {
+	serverSide, testSide := net.Pipe()
+	f.mu.Lock()
+	f.streams = append(f.streams, testSide)
+	f.mu.Unlock()
+	return serverSide, nil
+}
+
+func (f *fakeSession) AcceptStream() (net.Conn, error) { select {} }
+func (f *fakeSession) Close() error                    { return nil }
+func (f *fakeSession) IsClosed() bool                  { return false }
+func (f *fakeSession) Ping() (time.Duration, error)    { return 0, nil }
+
+// TestDrainListenerWaitsForActiveStream reproduces a reload that flips a
+// listener out of the config mid-session: drainListener must stop
+// accepting immediately but let an in-flight stream finish on its own
+// before it returns.
+func TestDrainListenerWaitsForActiveStream(t *testing.T) {
+	s := &Server{listeners: make(map[string]*userListener)}
+	session := &fakeSession{}
+
+	s.startListener("127.0.0.1:0", session)
+	s.mu.Lock()
+	ul := s.listeners["127.0.0.1:0"]
+	s.mu.Unlock()
+	addr := ul.listener.Addr().String()
+
+	userConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial listener: %v", err)
+	}
+
+	// Wait for acceptLoop to register the in-flight stream.
+	deadline := time.Now().Add(time.Second)
+	for {
+		session.mu.Lock()
+		n := len(session.streams)
+		session.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stream was never opened")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		s.drainListener(ul, time.Second)
+		close(drained)
+	}()
+
+	// The listener must stop accepting new connections right away...
+	deadline = time.Now().Add(time.Second)
+	for {
+		if _, err := net.Dial("tcp", addr); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("listener kept accepting connections after drain started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// ...but the already-open stream must still be alive.
+	select {
+	case <-drained:
+		t.Fatalf("drainListener returned before the in-flight stream closed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Closing both ends of the in-flight stream lets handleStream finish,
+	// which should let the drain complete well inside its timeout.
+	userConn.Close()
+	session.mu.Lock()
+	for _, c := range session.streams {
+		c.Close()
+	}
+	session.mu.Unlock()
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatalf("drainListener did not return after the stream closed")
+	}
+}
+
+// TestApplyListenerDiffRemovesImmediatelyFromTheActiveSet checks that a
+// reload that drops an address from UserListenAddr takes it out of
+// s.listeners (so it no longer shows up as active) right away, even
+// though the underlying drain keeps running in the background.
+func TestApplyListenerDiffRemovesImmediatelyFromTheActiveSet(t *testing.T) {
+	s := &Server{listeners: make(map[string]*userListener)}
+	session := &fakeSession{}
+
+	s.startListener("127.0.0.1:0", session)
+	s.mu.Lock()
+	_, present := s.listeners["127.0.0.1:0"]
+	s.mu.Unlock()
+	if !present {
+		t.Fatalf("expected startListener to register the listener")
+	}
+
+	s.applyListenerDiff(nil, 0)
+	s.mu.Lock()
+	_, stillThere := s.listeners["127.0.0.1:0"]
+	s.mu.Unlock()
+	if stillThere {
+		t.Fatalf("expected the listener to be removed from the active set immediately")
+	}
+}
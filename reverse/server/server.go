@@ -2,21 +2,17 @@
 package main
 
 import (
-	"crypto/rand"
+	"context"
 	"crypto/rsa"
 	"crypto/x509"
-	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"flag"
 	"io"
-	"log"
 	"net"
 	"os"
 	"sync"
 	"time"
-
-	"github.com/hashicorp/yamux"
 )
 
 // BufferPool is a pool of reusable buffers
@@ -26,11 +22,14 @@ var bufferPool = sync.Pool{
 	},
 }
 
-// copyBuffer copies from src to dst using a buffer from the pool
-func copyBuffer(dst io.Writer, src io.Reader) (written int64, err error) {
+// copyBuffer copies from src to dst using a buffer from the pool, counting
+// the bytes copied against tunnel_stream_bytes_total{direction}.
+func copyBuffer(dst io.Writer, src io.Reader, direction string) (written int64, err error) {
 	buf := bufferPool.Get().([]byte)
 	defer bufferPool.Put(buf)
-	return io.CopyBuffer(dst, src, buf)
+	written, err = io.CopyBuffer(dst, src, buf)
+	streamBytesTotal.WithLabelValues(direction).Add(float64(written))
+	return written, err
 }
 
 // YamuxConfig holds yamux configuration
@@ -40,6 +39,11 @@ type YamuxConfig struct {
 	KeepAliveInterval      int    `json:"keepAliveInterval"`      // milliseconds
 	ConnectionWriteTimeout int    `json:"connectionWriteTimeout"` // milliseconds
 	MaxStreamWindowSize    uint32 `json:"maxStreamWindowSize"`
+	// NumConn opens this many parallel TCP carriers (raw transport only)
+	// and stripes yamux frames across them via multiConn, instead of
+	// capping throughput at one socket's congestion window. 1 or unset
+	// keeps the original single-connection behavior.
+	NumConn int `json:"numConn"`
 }
 
 // Config holds server configuration
@@ -49,6 +53,47 @@ type Config struct {
 	Yamux            YamuxConfig `json:"yamux"`
 	PrivateKeyPath   string      `json:"privateKeyPath"`
 	SecretToken      string      `json:"secretToken"`
+	// NoiseStaticKeyPaths lists this server's Curve25519 static private
+	// keys, newest first, for the noise-ik handshake (see handshake.go).
+	// acceptNoiseIK tries each in turn, so an operator can prepend a new
+	// key and roll clients onto it before retiring the old one, with no
+	// restart-synchronized downtime. Required only when a client dials
+	// with Handshake: "noise-ik".
+	NoiseStaticKeyPaths []string `json:"noiseStaticKeyPaths"`
+	// Transport selects how the client's tunnel connection is accepted:
+	// "raw" (default), "tls-mimic" or "websocket". See transport.go.
+	Transport string `json:"transport"`
+	// AllowedBindRanges restricts which addresses the client may ask the
+	// control plane to publish listeners on (see control.go). Entries may
+	// be bare hosts or CIDRs; an empty list allows any address, matching
+	// the old behavior where UserListenAddr was trusted outright.
+	AllowedBindRanges []string `json:"allowedBindRanges"`
+	// Wire selects the carrier the session rides on: "tcp-yamux" (default)
+	// or "kcp-smux" (KCP with Reed-Solomon FEC, better suited to lossy WAN
+	// links). See wire.go and kcp.go.
+	Wire string    `json:"wire"`
+	KCP  KCPConfig `json:"kcp"`
+	// AdminAddr, if set, serves POST /admin/reload to trigger the same
+	// config reload as SIGHUP. See reload.go.
+	AdminAddr string `json:"adminAddr"`
+	// DrainTimeout bounds how long a removed UserListenAddr listener waits
+	// for its in-flight streams to finish before reload moves on.
+	DrainTimeout int `json:"drainTimeout"` // milliseconds
+	// TokenRotationGrace is how long the previous SecretToken is still
+	// accepted after a reload changes it, so in-flight reconnect attempts
+	// signed with the old token aren't rejected mid-rotation.
+	TokenRotationGrace int `json:"tokenRotationGrace"` // milliseconds
+	// MetricsAddr, if set, serves Prometheus metrics on GET /metrics. See
+	// metrics.go.
+	MetricsAddr string `json:"metricsAddr"`
+	// PingInterval is how often an active session is probed with
+	// session.Ping() to sample yamux_ping_rtt_seconds. Defaults to 30s.
+	PingInterval int `json:"pingInterval"` // milliseconds
+
+	// previousSecretToken/previousTokenDeadline implement the grace window
+	// above; set by Server.reload, never read from the config file.
+	previousSecretToken   string
+	previousTokenDeadline time.Time
 }
 
 func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
@@ -80,157 +125,12 @@ func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
 func main() {
 	configPath := flag.String("config", "server_config.json", "Path to config file")
 	flag.Parse()
-	for {
-		// Load config
-		file, err := os.Open(*configPath)
-		if err != nil {
-			log.Fatalf("Failed to open config: %v", err)
-		}
-		var cfg Config
-		if err := json.NewDecoder(file).Decode(&cfg); err != nil {
-			file.Close()
-			log.Fatalf("Failed to decode config: %v", err)
-		}
-		file.Close()
-		// Build yamux.Config from cfg.Yamux
-		yamuxConf := yamux.DefaultConfig()
-		yamuxConf.AcceptBacklog = cfg.Yamux.AcceptBacklog
-		yamuxConf.EnableKeepAlive = cfg.Yamux.EnableKeepAlive
-		yamuxConf.KeepAliveInterval = time.Duration(cfg.Yamux.KeepAliveInterval) * time.Millisecond
-		yamuxConf.ConnectionWriteTimeout = time.Duration(cfg.Yamux.ConnectionWriteTimeout) * time.Millisecond
-		if cfg.Yamux.MaxStreamWindowSize > 0 {
-			yamuxConf.MaxStreamWindowSize = cfg.Yamux.MaxStreamWindowSize
-		}
-
-		// Load server private key (path from config)
-		privateKey, err := loadPrivateKey(cfg.PrivateKeyPath)
-		if err != nil {
-			log.Printf("Failed to load private key: %v", err)
-			time.Sleep(3 * time.Second)
-			continue
-		}
-
-		// Listen for tunnel client
-		tunnelListener, err := net.Listen("tcp", cfg.TunnelListenAddr)
-		if err != nil {
-			log.Printf("Failed to listen for tunnel client: %v", err)
-			time.Sleep(3 * time.Second)
-			continue
-		}
-		log.Println("Waiting for tunnel client...")
-		tunnelConn, err := tunnelListener.Accept()
-		if err != nil {
-			log.Printf("Failed to accept tunnel client: %v", err)
-			tunnelListener.Close()
-			time.Sleep(3 * time.Second)
-			continue
-		}
-		log.Println("Tunnel client connected")
-		tunnelListener.Close()
-
-		// --- AUTHENTICATION HANDSHAKE ---
-		encToken := make([]byte, 256) // 256 bytes for 2048-bit key
-		if _, err := io.ReadFull(tunnelConn, encToken); err != nil {
-			log.Printf("Failed to read encrypted token: %v", err)
-			tunnelConn.Close()
-			time.Sleep(3 * time.Second)
-			continue
-		}
-		token, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, encToken)
-		if err != nil {
-			log.Printf("Failed to decrypt token: %v", err)
-			tunnelConn.Close()
-			time.Sleep(3 * time.Second)
-			continue
-		}
-		if string(token) != cfg.SecretToken {
-			log.Printf("Invalid token from client")
-			tunnelConn.Close()
-			time.Sleep(3 * time.Second)
-			continue
-		}
-		log.Println("Client authenticated successfully")
-		// --- END AUTHENTICATION HANDSHAKE ---
-
-		// Create yamux server session
-		session, err := yamux.Server(tunnelConn, yamuxConf)
-		if err != nil {
-			log.Printf("Failed to create yamux session: %v", err)
-			tunnelConn.Close()
-			time.Sleep(3 * time.Second)
-			continue
-		}
-
-		// Listen for external clients on userListenAddr
-		var listeners []net.Listener
-		for _, addr := range cfg.UserListenAddr {
-			l, err := net.Listen("tcp", addr)
-			if err != nil {
-				log.Printf("Failed to listen on %s: %v", addr, err)
-				continue
-			}
-			log.Printf("Listening for external clients on %s", addr)
-			listeners = append(listeners, l)
-		}
-		if len(listeners) == 0 {
-			log.Printf("No user listeners available, retrying in 3 seconds...")
-			session.Close()
-			tunnelConn.Close()
-			time.Sleep(3 * time.Second)
-			continue
-		}
-
-		// Accept connections on all listeners
-		stopChan := make(chan struct{})
-		for _, userListener := range listeners {
-			go func(userListener net.Listener) {
-				for {
-					select {
-					case <-stopChan:
-						userListener.Close()
-						return
-					default:
-					}
-					userConn, err := userListener.Accept()
-					if err != nil {
-						select {
-						case <-stopChan:
-							return
-						default:
-							log.Printf("Failed to accept user connection: %v", err)
-							break
-						}
-					}
-					log.Println("Accepted connection from external client")
-					go func(userConn net.Conn) {
-						defer userConn.Close()
-						// Open a new yamux stream to the client
-						stream, err := session.OpenStream()
-						if err != nil {
-							log.Printf("Failed to open yamux stream: %v", err)
-							// If session is closed, signal all listeners to stop
-							select {
-							case <-stopChan:
-								// already closed
-							default:
-								close(stopChan)
-							}
-							return
-						}
-						handleStream(userConn, stream)
-					}(userConn)
-				}
-			}(userListener)
-		}
-		// Wait for stopChan to be closed (session or OpenStream failure)
-		<-stopChan
-		for _, l := range listeners {
-			l.Close()
-		}
-		session.Close()
-		tunnelConn.Close()
-		log.Println("Connection lost, retrying in 3 seconds...")
-		time.Sleep(3 * time.Second)
+	s, err := NewServer(*configPath)
+	if err != nil {
+		log.Fatalf("Failed to load config: %v", err)
+	}
+	if err := s.Run(context.Background()); err != nil {
+		log.Fatalf("Server exited: %v", err)
 	}
 }
 
@@ -245,13 +145,13 @@ func handleStream(userConn net.Conn, stream net.Conn) {
 	// Copy from user to stream
 	go func() {
 		defer wg.Done()
-		copyBuffer(stream, userConn)
+		copyBuffer(stream, userConn, "in")
 	}()
 
 	// Copy from stream to user
 	go func() {
 		defer wg.Done()
-		copyBuffer(userConn, stream)
+		copyBuffer(userConn, stream, "out")
 	}()
 
 	wg.Wait()
@@ -0,0 +1,415 @@
+// transport.go
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// Transport abstracts how the tunnel connection from the client is
+// accepted, so the yamux session can ride over something other than a
+// bare TCP socket.
+type Transport interface {
+	AcceptTunnel(ctx context.Context, l net.Listener, cfg *Config) (net.Conn, error)
+}
+
+// newTransport builds the Transport named by cfg.Transport ("raw" if
+// unset).
+func newTransport(name string) (Transport, error) {
+	switch name {
+	case "", "raw":
+		return rawTransport{}, nil
+	case "tls-mimic":
+		return &tlsMimicTransport{seen: newReplayCache(1024)}, nil
+	case "websocket":
+		return websocketTransport{}, nil
+	default:
+		return nil, errors.New("unknown transport: " + name)
+	}
+}
+
+// rawTransport is the original behavior: a bare TCP accept. The RSA token
+// handshake is performed by the caller afterwards, same as before this
+// Transport abstraction existed.
+type rawTransport struct{}
+
+func (rawTransport) AcceptTunnel(ctx context.Context, l net.Listener, cfg *Config) (net.Conn, error) {
+	return l.Accept()
+}
+
+// websocketTransport wraps the yamux session inside an HTTP Upgrade so the
+// tunnel looks like ordinary web traffic to anything sniffing the TCP
+// stream (CDNs, reverse proxies, DPI boxes that only pass HTTP through).
+// The RSA token handshake still runs over the resulting connection, same
+// as rawTransport.
+type websocketTransport struct{}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  32 * 1024,
+	WriteBufferSize: 32 * 1024,
+	CheckOrigin:     func(*http.Request) bool { return true },
+}
+
+func (websocketTransport) AcceptTunnel(ctx context.Context, l net.Listener, cfg *Config) (net.Conn, error) {
+	connCh := make(chan net.Conn, 1)
+	errCh := make(chan error, 1)
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			wsConn, err := wsUpgrader.Upgrade(w, r, nil)
+			if err != nil {
+				select {
+				case errCh <- err:
+				default:
+				}
+				return
+			}
+			select {
+			case connCh <- newWSConn(wsConn):
+			default:
+				wsConn.Close()
+			}
+		}),
+	}
+	go srv.Serve(l)
+	defer srv.Close()
+	select {
+	case c := <-connCh:
+		return c, nil
+	case err := <-errCh:
+		return nil, err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// wsConn adapts a *websocket.Conn to net.Conn by buffering partial message
+// reads, since yamux expects a plain byte stream rather than framed
+// messages.
+type wsConn struct {
+	*websocket.Conn
+	readMu sync.Mutex
+	rest   []byte
+}
+
+func newWSConn(c *websocket.Conn) *wsConn {
+	return &wsConn{Conn: c}
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.rest) == 0 {
+		_, data, err := c.Conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.rest = data
+	}
+	n := copy(p, c.rest)
+	c.rest = c.rest[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.Conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// tlsMimicTransport makes the handshake look like a real TLS ClientHello/
+// ServerHello exchange (the ClientHello-smuggling trick from Cloak) while
+// actually carrying the RSA-encrypted auth token and a per-connection
+// session key inside the ClientHello's random/session_id/SNI fields.
+// Subsequent bytes are AEAD-wrapped with the session key before yamux
+// ever sees them.
+type tlsMimicTransport struct {
+	seen *replayCache
+}
+
+const (
+	tlsRecordHeaderLen    = 5
+	tlsHandshakeHeaderLen = 4
+	fakeClientRandomLen   = 32
+	fakeSessionIDLen      = 32
+	rsaCiphertextLen      = 256 // 2048-bit RSA key, PKCS#1 v1.5
+)
+
+func (t *tlsMimicTransport) AcceptTunnel(ctx context.Context, l net.Listener, cfg *Config) (net.Conn, error) {
+	conn, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := readFakeClientHello(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	privateKey, err := loadPrivateKey(cfg.PrivateKeyPath)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	payload, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, ciphertext)
+	if err != nil {
+		conn.Close()
+		return nil, errors.New("tls-mimic: failed to decrypt ClientHello payload")
+	}
+	if len(payload) < 32 {
+		conn.Close()
+		return nil, errors.New("tls-mimic: ClientHello payload too short")
+	}
+	token, sessionKey := payload[:len(payload)-32], payload[len(payload)-32:]
+	if !validToken(cfg, string(token)) {
+		conn.Close()
+		return nil, errors.New("tls-mimic: invalid token")
+	}
+	if !t.seen.insert(sessionKey) {
+		conn.Close()
+		return nil, errors.New("tls-mimic: replayed session key")
+	}
+	if err := writeFakeServerHello(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	aead, err := newAEADFromKey(sessionKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newAEADConn(conn, aead, true), nil
+}
+
+// readFakeClientHello reads a TLS-record-framed ClientHello and returns
+// the rsaCiphertextLen bytes of RSA ciphertext smuggled across its
+// random, session_id and fake SNI extension fields.
+func readFakeClientHello(conn net.Conn) ([]byte, error) {
+	header := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	recordLen := int(binary.BigEndian.Uint16(header[3:5]))
+	body := make([]byte, recordLen)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, err
+	}
+	if len(body) < tlsHandshakeHeaderLen+2+fakeClientRandomLen+1 {
+		return nil, errors.New("tls-mimic: short ClientHello")
+	}
+	off := tlsHandshakeHeaderLen + 2 // handshake header + client_version
+	random := body[off : off+fakeClientRandomLen]
+	off += fakeClientRandomLen
+	sessionIDLen := int(body[off])
+	off++
+	if sessionIDLen != fakeSessionIDLen || off+sessionIDLen > len(body) {
+		return nil, errors.New("tls-mimic: unexpected session_id length")
+	}
+	sessionID := body[off : off+sessionIDLen]
+	off += sessionIDLen
+	if off+2 > len(body) {
+		return nil, errors.New("tls-mimic: truncated cipher suites")
+	}
+	cipherSuitesLen := int(binary.BigEndian.Uint16(body[off : off+2]))
+	off += 2 + cipherSuitesLen
+	off += 2 // compression methods length byte + null method
+	if off+2 > len(body) {
+		return nil, errors.New("tls-mimic: truncated extensions")
+	}
+	off += 2 // extensions length
+	sniPayload, err := parseFakeSNIExtension(body[off:])
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, 0, rsaCiphertextLen)
+	ciphertext = append(ciphertext, random...)
+	ciphertext = append(ciphertext, sessionID...)
+	ciphertext = append(ciphertext, sniPayload...)
+	if len(ciphertext) != rsaCiphertextLen {
+		return nil, errors.New("tls-mimic: unexpected ciphertext length")
+	}
+	return ciphertext, nil
+}
+
+func parseFakeSNIExtension(b []byte) ([]byte, error) {
+	if len(b) < 4 {
+		return nil, errors.New("tls-mimic: missing server_name extension")
+	}
+	extLen := int(binary.BigEndian.Uint16(b[2:4]))
+	if len(b) < 4+extLen {
+		return nil, errors.New("tls-mimic: truncated extension")
+	}
+	serverNameList := b[4 : 4+extLen]
+	if len(serverNameList) < 5 {
+		return nil, errors.New("tls-mimic: truncated server_name_list")
+	}
+	hostLen := int(binary.BigEndian.Uint16(serverNameList[3:5]))
+	if len(serverNameList) < 5+hostLen {
+		return nil, errors.New("tls-mimic: truncated server_name")
+	}
+	return serverNameList[5 : 5+hostLen], nil
+}
+
+// writeFakeServerHello writes a TLS-record-framed ServerHello that carries
+// no hidden payload; it only needs to look plausible to DPI watching the
+// handshake complete.
+func writeFakeServerHello(conn net.Conn) error {
+	var body bytes.Buffer
+	body.Write([]byte{0x03, 0x03}) // server_version: TLS 1.2
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	body.Write(random)
+	body.WriteByte(32)
+	sessionID := make([]byte, 32)
+	if _, err := rand.Read(sessionID); err != nil {
+		return err
+	}
+	body.Write(sessionID)
+	body.Write([]byte{0xc0, 0x2f}) // cipher suite
+	body.WriteByte(0)              // compression method: null
+	body.Write([]byte{0x00, 0x00}) // no extensions
+
+	handshake := make([]byte, tlsHandshakeHeaderLen+body.Len())
+	handshake[0] = 0x02 // ServerHello
+	putUint24(handshake[1:4], uint32(body.Len()))
+	copy(handshake[4:], body.Bytes())
+
+	record := make([]byte, tlsRecordHeaderLen+len(handshake))
+	record[0] = 0x16 // handshake content type
+	record[1], record[2] = 0x03, 0x01
+	binary.BigEndian.PutUint16(record[3:5], uint16(len(handshake)))
+	copy(record[5:], handshake)
+	_, err := conn.Write(record)
+	return err
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
+
+// newAEADFromKey derives an AES-256-GCM AEAD from the tls-mimic session
+// key.
+func newAEADFromKey(key []byte) (cipher.AEAD, error) {
+	h := sha256.Sum256(key)
+	block, err := aes.NewCipher(h[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// aeadConn wraps a net.Conn so every write is sealed and every read is
+// opened with an AEAD keyed from the tls-mimic session secret. Frames are
+// a 4-byte big-endian length prefix followed by the sealed payload.
+type aeadConn struct {
+	net.Conn
+	aead              cipher.AEAD
+	writeDir, readDir byte
+	writeSeq, readSeq uint64
+	writeMu, readMu   sync.Mutex
+	readBuf           []byte
+}
+
+func newAEADConn(conn net.Conn, aead cipher.AEAD, isServer bool) *aeadConn {
+	c := &aeadConn{Conn: conn, aead: aead}
+	if isServer {
+		c.writeDir, c.readDir = 'S', 'C'
+	} else {
+		c.writeDir, c.readDir = 'C', 'S'
+	}
+	return c
+}
+
+func nonceFor(seq uint64, direction byte) []byte {
+	nonce := make([]byte, 12)
+	nonce[0] = direction
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+func (c *aeadConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	sealed := c.aead.Seal(nil, nonceFor(c.writeSeq, c.writeDir), p, nil)
+	c.writeSeq++
+	frame := make([]byte, 4+len(sealed))
+	binary.BigEndian.PutUint32(frame, uint32(len(sealed)))
+	copy(frame[4:], sealed)
+	if _, err := c.Conn.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *aeadConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if len(c.readBuf) == 0 {
+		lenHeader := make([]byte, 4)
+		if _, err := io.ReadFull(c.Conn, lenHeader); err != nil {
+			return 0, err
+		}
+		sealed := make([]byte, binary.BigEndian.Uint32(lenHeader))
+		if _, err := io.ReadFull(c.Conn, sealed); err != nil {
+			return 0, err
+		}
+		plain, err := c.aead.Open(nil, nonceFor(c.readSeq, c.readDir), sealed, nil)
+		if err != nil {
+			return 0, err
+		}
+		c.readSeq++
+		c.readBuf = plain
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// replayCache is a small LRU of session keys so a captured tls-mimic
+// ClientHello can't be replayed to re-authenticate.
+type replayCache struct {
+	mu    sync.Mutex
+	cap   int
+	order *list.List
+	index map[string]*list.Element
+}
+
+func newReplayCache(capacity int) *replayCache {
+	return &replayCache{cap: capacity, order: list.New(), index: make(map[string]*list.Element)}
+}
+
+// insert reports whether key is new (and records it); false means key was
+// already seen and the connection should be rejected as a replay.
+func (r *replayCache) insert(key []byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k := string(key)
+	if _, ok := r.index[k]; ok {
+		return false
+	}
+	if r.order.Len() >= r.cap {
+		if oldest := r.order.Back(); oldest != nil {
+			r.order.Remove(oldest)
+			delete(r.index, oldest.Value.(string))
+		}
+	}
+	r.index[k] = r.order.PushFront(k)
+	return true
+}
@@ -0,0 +1,245 @@
+// wire.go
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// Session is the subset of a multiplexed session (yamux or smux) the rest
+// of the server needs: opening/accepting streams and tearing the whole
+// thing down. Both *yamux.Session and *smux.Session are adapted to this
+// interface below.
+type Session interface {
+	OpenStream() (net.Conn, error)
+	AcceptStream() (net.Conn, error)
+	Close() error
+	IsClosed() bool
+	// Ping round-trips a keepalive frame and reports how long it took, for
+	// the yamux_ping_rtt_seconds metric (see metrics.go). Sessions that
+	// can't support it (smux, see kcp.go) return an error.
+	Ping() (time.Duration, error)
+}
+
+// Wire abstracts the net.Listener/net.Dialer pair and the session
+// constructor, so the tunnel can run over plain TCP+yamux (the original
+// design) or over KCP+smux (see kcp.go, better suited to lossy WAN links)
+// without the rest of the server caring which.
+type Wire interface {
+	Listen(cfg *Config) (WireListener, error)
+}
+
+// WireListener accepts one client connection at a time, running whatever
+// handshake/session-construction this wire requires, and hands back an
+// established Session plus the underlying carrier(s) to close when the
+// session ends.
+type WireListener interface {
+	Accept(ctx context.Context, cfg *Config) (Session, io.Closer, error)
+	Close() error
+}
+
+func newWire(name string) (Wire, error) {
+	switch name {
+	case "", "tcp-yamux":
+		return tcpYamuxWire{}, nil
+	case "kcp-smux":
+		return kcpSmuxWire{}, nil
+	default:
+		return nil, fmt.Errorf("unknown wire: %s", name)
+	}
+}
+
+func buildYamuxConfig(cfg YamuxConfig) *yamux.Config {
+	yamuxConf := yamux.DefaultConfig()
+	yamuxConf.AcceptBacklog = cfg.AcceptBacklog
+	yamuxConf.EnableKeepAlive = cfg.EnableKeepAlive
+	yamuxConf.KeepAliveInterval = time.Duration(cfg.KeepAliveInterval) * time.Millisecond
+	yamuxConf.ConnectionWriteTimeout = time.Duration(cfg.ConnectionWriteTimeout) * time.Millisecond
+	if cfg.MaxStreamWindowSize > 0 {
+		yamuxConf.MaxStreamWindowSize = cfg.MaxStreamWindowSize
+	}
+	return yamuxConf
+}
+
+// authenticateTunnelConn reads the handshake version byte and runs
+// whichever scheme it names: the legacy RSA-PKCS1v15 token exchange, or
+// the noise-ik mutually-authenticated handshake (see handshake.go). It's
+// shared by every wire/transport combination that doesn't authenticate as
+// part of its own handshake (tls-mimic does). The returned net.Conn is
+// conn itself for the legacy path, or conn wrapped in per-session AEAD
+// framing for noise-ik. The returned []byte is the legacy path's session
+// key (for binding acceptMultiConnSockets to this session, see
+// multiconn.go), or nil for noise-ik.
+func authenticateTunnelConn(conn net.Conn, cfg *Config) (net.Conn, []byte, error) {
+	verByte := make([]byte, 1)
+	if _, err := io.ReadFull(conn, verByte); err != nil {
+		err = fmt.Errorf("failed to read handshake version: %w", err)
+		recordHandshakeFailure("read_version", err)
+		return nil, nil, err
+	}
+	switch verByte[0] {
+	case handshakeVersionNoiseIK:
+		securedConn, err := acceptNoiseIK(conn, cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return securedConn, nil, nil
+	case handshakeVersionLegacy:
+		privateKey, err := loadPrivateKey(cfg.PrivateKeyPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		sessionKey, err := authenticateLegacyToken(conn, privateKey, cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, sessionKey, nil
+	default:
+		err := fmt.Errorf("unknown handshake version byte 0x%02x", verByte[0])
+		recordHandshakeFailure("unknown_version", err)
+		return nil, nil, err
+	}
+}
+
+// authenticateLegacyToken performs the legacy RSA-PKCS1v15 token handshake
+// read side: the encrypted token, then the client's freshly generated
+// session key (also RSA-sealed, in its own block). The returned session
+// key is only ever known to the two ends of this handshake, so it doubles
+// as the per-session secret acceptMultiConnSockets binds extra carriers to.
+func authenticateLegacyToken(conn net.Conn, privateKey *rsa.PrivateKey, cfg *Config) ([]byte, error) {
+	encToken := make([]byte, 256) // 256 bytes for 2048-bit key
+	if _, err := io.ReadFull(conn, encToken); err != nil {
+		err = fmt.Errorf("failed to read encrypted token: %w", err)
+		recordHandshakeFailure("read_token", err)
+		return nil, err
+	}
+	token, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, encToken)
+	if err != nil {
+		err = fmt.Errorf("failed to decrypt token: %w", err)
+		recordHandshakeFailure("decrypt_token", err)
+		return nil, err
+	}
+	if !validToken(cfg, string(token)) {
+		err := fmt.Errorf("invalid token from client")
+		recordHandshakeFailure("invalid_token", err)
+		return nil, err
+	}
+	encSessionKey := make([]byte, 256)
+	if _, err := io.ReadFull(conn, encSessionKey); err != nil {
+		err = fmt.Errorf("failed to read encrypted session key: %w", err)
+		recordHandshakeFailure("read_session_key", err)
+		return nil, err
+	}
+	sessionKey, err := rsa.DecryptPKCS1v15(rand.Reader, privateKey, encSessionKey)
+	if err != nil {
+		err = fmt.Errorf("failed to decrypt session key: %w", err)
+		recordHandshakeFailure("decrypt_session_key", err)
+		return nil, err
+	}
+	return sessionKey, nil
+}
+
+// validToken reports whether token matches the current SecretToken, or the
+// token being rotated away from while still inside its grace window (see
+// Server.reload).
+func validToken(cfg *Config, token string) bool {
+	if token == cfg.SecretToken {
+		return true
+	}
+	return cfg.previousSecretToken != "" && token == cfg.previousSecretToken && time.Now().Before(cfg.previousTokenDeadline)
+}
+
+// yamuxSessionAdapter adapts *yamux.Session's concretely-typed stream
+// methods to the generic Session interface.
+type yamuxSessionAdapter struct{ s *yamux.Session }
+
+func (a yamuxSessionAdapter) OpenStream() (net.Conn, error)   { return a.s.OpenStream() }
+func (a yamuxSessionAdapter) AcceptStream() (net.Conn, error) { return a.s.AcceptStream() }
+func (a yamuxSessionAdapter) Close() error                    { return a.s.Close() }
+func (a yamuxSessionAdapter) IsClosed() bool                  { return a.s.IsClosed() }
+func (a yamuxSessionAdapter) Ping() (time.Duration, error)    { return a.s.Ping() }
+
+// --- tcp-yamux ---------------------------------------------------------
+
+// tcpYamuxWire is the original transport: a TCP listener (optionally
+// wrapped by a Transport, see transport.go), the authentication handshake
+// (legacy RSA token or noise-ik, see authenticateTunnelConn), an optional
+// multiConn carrier pool, and a yamux session on top.
+type tcpYamuxWire struct{}
+
+type tcpYamuxListener struct {
+	listener  net.Listener
+	transport Transport
+}
+
+func (tcpYamuxWire) Listen(cfg *Config) (WireListener, error) {
+	l, err := net.Listen("tcp", cfg.TunnelListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	transport, err := newTransport(cfg.Transport)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &tcpYamuxListener{listener: l, transport: transport}, nil
+}
+
+func (tl *tcpYamuxListener) Close() error { return tl.listener.Close() }
+
+func (tl *tcpYamuxListener) Accept(ctx context.Context, cfg *Config) (Session, io.Closer, error) {
+	tunnelConn, err := tl.transport.AcceptTunnel(ctx, tl.listener, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var sessionKey []byte
+	if cfg.Transport != "tls-mimic" {
+		securedConn, sk, err := authenticateTunnelConn(tunnelConn, cfg)
+		if err != nil {
+			tunnelConn.Close()
+			return nil, nil, err
+		}
+		tunnelConn = securedConn
+		sessionKey = sk
+		log.Println("Client authenticated successfully")
+	}
+
+	var muxConn net.Conn = tunnelConn
+	if cfg.Yamux.NumConn > 1 {
+		_, noiseSecured := tunnelConn.(*noiseFramedConn)
+		switch {
+		case cfg.Transport != "" && cfg.Transport != "raw":
+			log.Printf("yamux.numConn > 1 is only supported with the raw transport; continuing with a single connection")
+		case noiseSecured:
+			// The extra carriers accepted below are plaintext TCP
+			// sockets; striping them alongside a noise-ik-secured socket
+			// 0 would put most yamux frames on the wire in the clear.
+			// Refuse rather than silently defeat the handshake's
+			// confidentiality.
+			log.Printf("yamux.numConn > 1 is not supported with the noise-ik handshake; continuing with a single connection")
+		default:
+			extraConns, err := acceptMultiConnSockets(tl.listener, cfg.Yamux.NumConn-1, sessionKey)
+			if err != nil {
+				tunnelConn.Close()
+				return nil, nil, fmt.Errorf("failed to accept additional carrier connections: %w", err)
+			}
+			muxConn = newMultiConn(append([]net.Conn{tunnelConn}, extraConns...))
+			log.Printf("Accepted %d parallel carrier connections", cfg.Yamux.NumConn)
+		}
+	}
+
+	session, err := yamux.Server(muxConn, buildYamuxConfig(cfg.Yamux))
+	if err != nil {
+		muxConn.Close()
+		return nil, nil, err
+	}
+	return yamuxSessionAdapter{session}, muxConn, nil
+}
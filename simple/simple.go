@@ -1,17 +1,73 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io"
-	"log"
 	"net"
+	"net/http"
 	"os"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+// log replaces the stdlib log package so messages get levels and
+// timestamps instead of bare Printf text.
+var log = logrus.New()
+
+var (
+	connectionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "forwarder_connections_total",
+		Help: "Client connections accepted by the port forwarder.",
+	})
+	bytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "forwarder_bytes_total",
+		Help: "Bytes relayed between the client and the remote address, by direction.",
+	}, []string{"direction"})
 )
 
+// bufferPool is a pool of reusable buffers for copyBuffer.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 32*1024) // 32KB buffer size
+	},
+}
+
+// copyBuffer copies from src to dst using a buffer from the pool, counting
+// the bytes copied against forwarder_bytes_total{direction}.
+func copyBuffer(dst io.Writer, src io.Reader, direction string) (written int64, err error) {
+	buf := bufferPool.Get().([]byte)
+	defer bufferPool.Put(buf)
+	written, err = io.CopyBuffer(dst, src, buf)
+	bytesTotal.WithLabelValues(direction).Add(float64(written))
+	return written, err
+}
+
+// serveMetrics runs the Prometheus /metrics endpoint on addr until ctx is
+// canceled.
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	httpServer := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.WithError(err).Error("metrics endpoint failed")
+	}
+}
+
 // Config holds the configuration loaded from config.json
 type Config struct {
 	LocalAddr  string `json:"localAddr"`
 	RemoteAddr string `json:"remoteAddr"`
+	// MetricsAddr, if set, serves Prometheus metrics on GET /metrics.
+	MetricsAddr string `json:"metricsAddr"`
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -38,6 +94,10 @@ func main() {
 	localAddr := cfg.LocalAddr
 	remoteAddr := cfg.RemoteAddr
 
+	if cfg.MetricsAddr != "" {
+		go serveMetrics(context.Background(), cfg.MetricsAddr)
+	}
+
 	listener, err := net.Listen("tcp", localAddr)
 	if err != nil {
 		log.Fatalf("Failed to listen on %s: %v", localAddr, err)
@@ -55,6 +115,7 @@ func main() {
 		}
 
 		log.Printf("Accepted connection from %s", clientConn.RemoteAddr())
+		connectionsTotal.Inc()
 
 		go handleConnection(clientConn, remoteAddr)
 	}
@@ -78,7 +139,7 @@ func handleConnection(clientConn net.Conn, remoteAddr string) {
 
 	go func() {
 
-		_, err := io.Copy(remoteConn, clientConn)
+		_, err := copyBuffer(remoteConn, clientConn, "out")
 		if err != nil {
 
 			log.Printf("Error copying from client to remote: %v", err)
@@ -87,7 +148,7 @@ func handleConnection(clientConn net.Conn, remoteAddr string) {
 	}()
 
 	go func() {
-		_, err := io.Copy(clientConn, remoteConn)
+		_, err := copyBuffer(clientConn, remoteConn, "in")
 		if err != nil {
 			log.Printf("Error copying from remote to client: %v", err)
 		}